@@ -9,12 +9,14 @@ var (
 	buildPath                    string
 	repositoryConfigPath         string
 	helmRegistrySecretConfigPath string
+	buildStrict                  bool
 )
 
 func init() {
 	buildCmd.PersistentFlags().StringVar(&buildPath, "path", "", "Path to the application")
 	buildCmd.PersistentFlags().StringVar(&repositoryConfigPath, "repository-path", "", "Repository config, default to /helm-working-dir/")
 	buildCmd.PersistentFlags().StringVar(&helmRegistrySecretConfigPath, "helm-registry-secret-config-path", "", "Repository config, default to /helm-working-dir/plugin-repositories/repositories.yaml")
+	buildCmd.PersistentFlags().BoolVar(&buildStrict, "strict", false, "Fail when a placeholder can't be resolved")
 	rootCmd.AddCommand(buildCmd)
 }
 
@@ -22,6 +24,9 @@ var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Similar to helm dependency build",
 	Run: func(cmd *cobra.Command, args []string) {
-		app.NewBuilder().Build(buildPath, repositoryConfigPath, helmRegistrySecretConfigPath)
+		builder := app.NewBuilder()
+		builder.Strict = buildStrict
+		builder.Config = loadPluginConfig()
+		builder.Build(buildPath, repositoryConfigPath, helmRegistrySecretConfigPath)
 	},
 }
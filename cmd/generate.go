@@ -5,7 +5,12 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	generateStrict bool
+)
+
 func init() {
+	generateCmd.PersistentFlags().BoolVar(&generateStrict, "strict", false, "Fail when a placeholder can't be resolved")
 	rootCmd.AddCommand(generateCmd)
 }
 
@@ -13,6 +18,9 @@ var generateCmd = &cobra.Command{
 	Use:   "generate",
 	Short: "take a template, substitute env vars and output the result",
 	Run: func(cmd *cobra.Command, args []string) {
-		app.NewGenerator().Generate()
+		generator := app.NewGenerator()
+		generator.Strict = generateStrict
+		generator.Config = loadPluginConfig()
+		generator.Generate()
 	},
 }
@@ -2,10 +2,24 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/spf13/cobra"
+	"log"
 	"os"
+
+	app "github.com/qjoly/argocd-plugin-helm-envsubst/internal"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pluginConfigPath string
 )
 
+func init() {
+	// Every log line, errors included, goes through the redaction of the
+	// secrets resolved while running
+	log.SetOutput(app.NewRedactingWriter(os.Stderr))
+	rootCmd.PersistentFlags().StringVar(&pluginConfigPath, "config", "", "Plugin config, default to $ENVSUBST_PLUGIN_CONFIG or /helm-working-dir/plugin-config.yaml")
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "argocd-helm-envsubst-plugin",
 	Short: "Argocd plugin that supports helm template with envsubst",
@@ -23,3 +37,11 @@ func Execute() {
 		os.Exit(1)
 	}
 }
+
+func loadPluginConfig() *app.PluginConfig {
+	config, err := app.LoadPluginConfig(pluginConfigPath)
+	if err != nil {
+		log.Fatalf("Error loading plugin config: %v", err)
+	}
+	return config
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	app "github.com/qjoly/argocd-plugin-helm-envsubst/internal"
+	"github.com/spf13/cobra"
+)
+
+var (
+	varsPath   string
+	varsOutput string
+)
+
+func init() {
+	varsCmd.PersistentFlags().StringVar(&varsPath, "path", "", "Directory of the Application manifests, default to stdin")
+	varsCmd.PersistentFlags().StringVarP(&varsOutput, "output", "o", app.TextOutput, "Output format, text or json")
+	rootCmd.AddCommand(varsCmd)
+}
+
+var varsCmd = &cobra.Command{
+	Use:   "vars",
+	Short: "List the placeholders and how they resolve, values being masked",
+	Run: func(cmd *cobra.Command, args []string) {
+		lister := app.NewVariableLister()
+		lister.Output = varsOutput
+		lister.Config = loadPluginConfig()
+		lister.List(varsPath)
+	},
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// avpPathAnnotation is the secret path of the <key> placeholders
+	avpPathAnnotation = "avp.kubernetes.io/path"
+	// avpIgnoreAnnotation disables the AVP placeholders of a manifest
+	avpIgnoreAnnotation = "avp.kubernetes.io/ignore"
+)
+
+// avpKey matches the keys of the <key> placeholders.
+var avpKey = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// avpModifiers maps the argocd-vault-plugin modifiers to filters.
+var avpModifiers = map[string]string{
+	"base64encode": "b64enc",
+	"base64decode": "b64dec",
+}
+
+// parsePlaceholder parses the expression found between '<' and '>' in the
+// argocd-vault-plugin syntax:
+//
+//	<path:secret/data/app#key>           key of the secret at that path
+//	<path:secret/data/app#key#version>   same, for a version of a KV v2 secret
+//	<key>                                key of the secret at the path set by
+//	                                     the avp.kubernetes.io/path annotation
+//	<path:secret/data/app#key | base64encode>
+//
+// The path is resolved by the reference provider of the AVP backend, e.g.
+// <path:secret/data/app#key> reads #vault:secret/data/app#key#.
+func (options AVPOptions) parsePlaceholder(raw string, expr string) *placeholder {
+	pipeline := splitPipeline(expr)
+	ref := strings.TrimSpace(pipeline[0])
+
+	var path, key string
+	if location, ok := strings.CutPrefix(ref, "path:"); ok {
+		if path, key, ok = strings.Cut(location, "#"); !ok || path == "" || key == "" {
+			return nil
+		}
+	} else {
+		if !avpKey.MatchString(ref) || len(options.Path) <= 0 {
+			return nil
+		}
+		path, key = options.Path, ref
+	}
+
+	p := &placeholder{raw: raw}
+	switch options.Backend {
+	case kubernetesReferenceScheme:
+		// The path is the [namespace/]name of a Secret
+		p.name = fmt.Sprintf("%s:secret/%s/%s", kubernetesReferenceScheme, strings.Trim(path, "/"), key)
+	default:
+		p.name = fmt.Sprintf("%s:%s#%s", vaultReferenceScheme, path, key)
+	}
+
+	for _, modifier := range pipeline[1:] {
+		modifier = strings.TrimSpace(modifier)
+		name, args, _ := strings.Cut(modifier, " ")
+		if filter, ok := avpModifiers[name]; ok {
+			modifier = strings.TrimSpace(filter + " " + args)
+		}
+		if modifier == "" {
+			return nil
+		}
+		p.filters = append(p.filters, modifier)
+	}
+	return p
+}
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestAVPPlaceholders(t *testing.T) {
+	server, _ := newFakeVault(t)
+	t.Setenv("VAULT_TOKEN", "static-token")
+
+	config := DefaultPluginConfig()
+	config.References.Vault = VaultReferencesConfig{Enabled: true, Address: server.URL}
+	config.Substitution.AVP.Enabled = true
+	chain := newTestProviderChain(t, config)
+
+	application := Application{Metadata: Metadata{Annotations: map[string]string{avpPathAnnotation: "secret/data/app"}}}
+	values := `password: <path:secret/data/app#password>
+key: <password>
+encoded: <path:secret/data/app#password | base64encode>
+versioned: <path:secret/data/app#password#3>
+`
+	want := `password: s3cr3t
+key: s3cr3t
+encoded: czNjcjN0
+versioned: s3cr3t
+`
+
+	got, err := applyEnvOnValues([]byte(values), chain, substitutionOptions(config, application, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Without the path annotation, only the <path:...> placeholders are substituted
+	html := "html: <b>bold</b> <path:secret/data/app#password>\n"
+	got, err = applyEnvOnValues([]byte(html), chain, substitutionOptions(config, Application{}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "html: <b>bold</b> s3cr3t\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	application.Metadata.Annotations[avpIgnoreAnnotation] = "true"
+	got, err = applyEnvOnValues([]byte(values), chain, substitutionOptions(config, application, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != values {
+		t.Errorf("got %q, want the values untouched", got)
+	}
+}
+
+func TestAVPKubernetesBackend(t *testing.T) {
+	options := AVPOptions{Enabled: true, Backend: kubernetesReferenceScheme, Path: "my-ns/db-creds"}
+
+	tests := map[string]string{
+		"path:my-ns/db-creds#password": "k8s:secret/my-ns/db-creds/password",
+		"password":                     "k8s:secret/my-ns/db-creds/password",
+		"path:db-creds#password":       "k8s:secret/db-creds/password",
+	}
+	for expr, want := range tests {
+		p := options.parsePlaceholder("<"+expr+">", expr)
+		if p == nil || p.name != want {
+			t.Errorf("parsePlaceholder(%q) = %+v, want %s", expr, p, want)
+		}
+	}
+}
@@ -2,13 +2,17 @@ package internal
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"filippo.io/age"
 	"gopkg.in/yaml.v2"
 )
 
@@ -36,10 +40,17 @@ type Repository struct {
 	Url                   string `default:"" yaml:"url"`
 }
 
-type Builder struct{}
+type Builder struct {
+	// Strict fails the build when a placeholder can't be resolved
+	Strict bool
+	Config *PluginConfig
+
+	// ageIdentities are loaded on the first SOPS file
+	ageIdentities []age.Identity
+}
 
 func NewBuilder() *Builder {
-	return &Builder{}
+	return &Builder{Config: DefaultPluginConfig()}
 }
 
 func (builder *Builder) Build(helmChartPath string, repoConfigPath string, helmRegistrySecretConfigPath string) {
@@ -111,6 +122,27 @@ func (builder *Builder) Build(helmChartPath string, repoConfigPath string, helmR
 
 	log.Printf("Created temp directory: %s\n", tempDir)
 
+	// The providers are shared by all the Applications, so that their caches
+	// last for the whole build
+	chain, err := newProviderChain(builder.Config)
+	if err != nil {
+		log.Fatalf("Error creating value providers: %v", err)
+	}
+	if err := chain.loadDotenv(absPath); err != nil {
+		log.Fatalf("Error reading dotenv files: %v", err)
+	}
+	if err := chain.loadSchema(absPath); err != nil {
+		log.Fatalf("Error reading variable schema: %v", err)
+	}
+	if err := chain.validateSchema(); err != nil {
+		log.Fatalf("Invalid variables:\n%v", err)
+	}
+
+	// Substitution errors are collected so that every missing variable,
+	// every value file outside of the repository, and every unavailable ref
+	// source, of every Application is reported at once
+	var substitutionErrs []error
+
 	for _, file := range files {
 
 		// Skip if file is a directory or not a yaml file
@@ -130,103 +162,446 @@ func (builder *Builder) Build(helmChartPath string, repoConfigPath string, helmR
 
 		log.Println("Manifest name:", application.Metadata.Name)
 
-		helmRegistry := application.Spec.Source.RepoURL
-		if !strings.HasPrefix(helmRegistry, "https://") {
-			log.Println("Helm registry is not https, skipping...")
+		sources := application.Spec.sources()
+		refs, err := resolveRefs(sources, absPath)
+		if err != nil {
+			substitutionErrs = append(substitutionErrs, prefixErrors(fmt.Sprintf("%s (%s)", file.Name(), application.Metadata.Name), err))
 			continue
 		}
 
-		sysCommand := "helm"
-		sysArgs := []string{"pull", application.Spec.Source.Chart, "--repo", application.Spec.Source.RepoURL, "--untar", "--untardir", tempDir}
-		sysCmd := exec.Command(sysCommand, sysArgs...)
-		var out, stderr bytes.Buffer
-		sysCmd.Stdout = &out
+		// Every chart source is rendered on its own, the manifests of a
+		// multi-source Application are written together
+		var manifests []byte
+		var buildInfos []BuildInfo
+		errCount := len(substitutionErrs)
+		for i, source := range sources {
+			// A source without chart is a chart of the repository when it has a path
+			isLocal := len(source.Chart) <= 0 && len(source.Path) > 0
+			if len(source.Chart) <= 0 && !isLocal {
+				if len(source.Ref) <= 0 {
+					log.Printf("Source %d has no chart, skipping...", i)
+				}
+				continue
+			}
+			if !isLocal && !strings.HasPrefix(source.RepoURL, ociScheme) && !strings.HasPrefix(source.RepoURL, "https://") {
+				log.Println("Helm registry is neither https nor oci, skipping...")
+				continue
+			}
+
+			sourceDir := filepath.Join(tempDir, application.Metadata.Name, "sources", strconv.Itoa(i))
+			if err := os.MkdirAll(sourceDir, 0700); err != nil {
+				log.Fatalf("Error creating source directory: %v", err)
+			}
+			var chartPath string
+			var buildInfo BuildInfo
+			if isLocal {
+				var err error
+				chartPath, buildInfo, err = builder.localChart(source, sourceDir, absPath)
+				if err != nil {
+					log.Printf("Source %d is not a chart: %v, skipping...", i, err)
+					continue
+				}
+			} else {
+				chartPath, buildInfo = builder.pullChart(source, sourceDir, helmRegistrySecretConfigPath)
+			}
+			// Packaged charts hold their dependencies
+			if !strings.HasSuffix(source.Path, ".tgz") {
+				builder.buildDependencies(chartPath, repoConfigPath+application.Metadata.Name+".yaml")
+			}
+
+			valuesArgs, err := builder.valuesArgs(source, chartPath, sourceDir, absPath, refs, chain, application)
+			if err != nil {
+				substitutionErrs = append(substitutionErrs, prefixErrors(fmt.Sprintf("%s (%s)", file.Name(), application.Metadata.Name), err))
+				continue
+			}
+			manifests = append(manifests, builder.template(application, source, chartPath, valuesArgs)...)
+			buildInfos = append(buildInfos, buildInfo)
+		}
+		if len(substitutionErrs) > errCount || len(buildInfos) <= 0 {
+			continue
+		}
+
+		buildDir := filepath.Join(tempDir, application.Metadata.Name)
+		if err := os.MkdirAll(buildDir, 0700); err != nil {
+			log.Fatalf("Error creating build directory: %v", err)
+		}
+		buildPath := filepath.Join(buildDir, "build.yaml")
+		err = os.WriteFile(buildPath, manifests, 0600)
+		if err != nil {
+			log.Fatalf("Error writing override values: %v", err)
+		}
+		if err := writeBuildInfo(filepath.Join(buildDir, buildInfoFile), buildInfos); err != nil {
+			log.Fatalf("Error writing build info: %v", err)
+		}
+		// The rendered manifests hold the substituted secrets, they are
+		// only output by the render command
+		log.Printf("Rendered %s to %s", application.Metadata.Name, buildPath)
+	}
+
+	if len(substitutionErrs) > 0 {
+		log.Fatalf("Error substituting env:\n%v", errors.Join(substitutionErrs...))
+	}
+
+	//	log.Fatal("stop here")
+
+	// Use app name as config file name
+	// repositoryConfigName := repoConfigPath + chartYaml["name"].(string) + ".yaml"
+	// log.Printf("repositoryConfigName: %s\n", repositoryConfigName)
+
+	// log.Println("Generating repository config...")
+	// builder.generateRepositoryConfig(repositoryConfigName, chartYaml, helmRegistrySecretConfigPath)
+
+	// log.Println("Executing helm dependency build...")
+	// builder.executeHelmDependencyBuild(repositoryConfigName)
+
+	// log.Println("Build process completed.")
+}
+
+// applyEnvOnValuesFile decrypts the values when they are encrypted with
+// SOPS, then substitutes them. The decrypted values only live in memory.
+func (builder *Builder) applyEnvOnValuesFile(values []byte, name string, chain *ProviderChain, application Application) ([]byte, error) {
+	if isSOPSEncrypted(values) {
+		log.Printf("Decrypting SOPS values %s", name)
+		if builder.ageIdentities == nil {
+			identities, err := loadAgeIdentities(builder.Config.SOPS)
+			if err != nil {
+				return nil, err
+			}
+			builder.ageIdentities = identities
+		}
+
+		decrypted, err := decryptSOPS(values, builder.ageIdentities)
+		if err != nil {
+			return nil, err
+		}
+		values = decrypted
+	}
+	return applyEnvOnValues(values, chain, substitutionOptions(builder.Config, application, builder.Strict))
+}
+
+// pullChart pulls the chart of a source in dir, and returns its path with
+// the version it was resolved to.
+func (builder *Builder) pullChart(source Source, dir string, helmRegistrySecretConfigPath string) (string, BuildInfo) {
+	username, password := "", ""
+	if _, err := os.Stat(helmRegistrySecretConfigPath); err == nil {
+		username, password = builder.readRepositoryConfig(source.RepoURL, helmRegistrySecretConfigPath)
+	}
+
+	digest := ""
+	if strings.HasPrefix(source.RepoURL, ociScheme) {
+		digest = builder.pullOCIChart(source, dir, username, password)
+	} else {
+		// The targetRevision is resolved against the repository index, so
+		// that the version deployed by a revision is known
+		repository := &chartRepository{url: source.RepoURL, username: username, password: password}
+		version, index, err := repository.resolveChartVersion(source.Chart, source.TargetRevision)
+		if err != nil {
+			log.Fatalf("Error resolving chart version: %v", err)
+		}
+
+		// The credentials are given to helm in a repository config, removed
+		// once the chart is pulled
+		repositoryDir := filepath.Join(dir, "repository")
+		configArgs, err := repository.helmConfig(repositoryDir, index, source.Helm.PassCredentials)
+		if err != nil {
+			log.Fatalf("Error writing repository config: %v", err)
+		}
+		sysArgs := []string{"pull", chartRepositoryName + "/" + source.Chart, "--untar", "--untardir", dir}
+		if len(version) > 0 {
+			sysArgs = append(sysArgs, "--version", version)
+		}
+		sysArgs = append(sysArgs, configArgs...)
+		var stderr bytes.Buffer
+		sysCmd := exec.Command("helm", sysArgs...)
 		sysCmd.Stderr = &stderr
 		err = sysCmd.Run()
+		os.RemoveAll(repositoryDir)
 		if err != nil {
 			log.Fatalf("Error running helm pull: %s\n%s", err, stderr.String())
 		}
-		err = cleanupTempDir(tempDir)
+		err = cleanupTempDir(dir)
 		if err != nil {
 			log.Fatalf("Error cleaning up temp directory: %v", err)
 		}
+	}
+
+	chartPath := filepath.Join(dir, path.Base(source.Chart))
+	if _, err := os.Stat(chartPath); os.IsNotExist(err) {
+		log.Fatalf("Directory %s does not exist", chartPath)
+	}
+
+	buildInfo := BuildInfo{
+		RepoURL:        source.RepoURL,
+		Chart:          source.Chart,
+		TargetRevision: source.TargetRevision,
+		Version:        fmt.Sprint(ReadChartYaml(chartPath)["version"]),
+		Digest:         digest,
+	}
+	if len(buildInfo.TargetRevision) > 0 {
+		log.Printf("Resolved chart %s %s to version %s", buildInfo.Chart, buildInfo.TargetRevision, buildInfo.Version)
+	} else {
+		log.Printf("Resolved chart %s to its latest version %s", buildInfo.Chart, buildInfo.Version)
+	}
+	return chartPath, buildInfo
+}
 
-		chartPath := filepath.Join(tempDir, application.Spec.Source.Chart)
-		if _, err := os.Stat(chartPath); os.IsNotExist(err) {
-			log.Fatalf("Directory %s does not exist", chartPath)
+// localChart returns the path of a chart of the repository. A packaged
+// chart is extracted in dir, a chart directory is rendered in place so that
+// its file:// dependencies are found.
+func (builder *Builder) localChart(source Source, dir string, manifestDir string) (string, BuildInfo, error) {
+	sourcePath, err := localSourcePath(source, manifestDir)
+	if err != nil {
+		return "", BuildInfo{}, err
+	}
+
+	chartPath := sourcePath
+	if strings.HasSuffix(sourcePath, ".tgz") {
+		archive, err := os.ReadFile(sourcePath)
+		if err != nil {
+			return "", BuildInfo{}, fmt.Errorf("read chart archive %s: %w", source.Path, err)
 		}
+		if err := extractChart(archive, dir); err != nil {
+			return "", BuildInfo{}, fmt.Errorf("extract chart archive %s: %w", source.Path, err)
+		}
+		if chartPath, err = archiveChartDir(dir); err != nil {
+			return "", BuildInfo{}, err
+		}
+	} else if _, err := os.Stat(filepath.Join(chartPath, "Chart.yaml")); err != nil {
+		return "", BuildInfo{}, fmt.Errorf("no Chart.yaml found in %s", source.Path)
+	}
+
+	chartYaml := ReadChartYaml(chartPath)
+	buildInfo := BuildInfo{
+		RepoURL:        source.RepoURL,
+		Chart:          fmt.Sprint(chartYaml["name"]),
+		Path:           source.Path,
+		TargetRevision: source.TargetRevision,
+		Version:        fmt.Sprint(chartYaml["version"]),
+	}
+	log.Printf("Using chart %s %s from %s", buildInfo.Chart, buildInfo.Version, source.Path)
+	return chartPath, buildInfo, nil
+}
 
-		chartYaml := ReadChartYaml(chartPath)
+// buildDependencies runs helm dependency build when the chart has dependencies.
+func (builder *Builder) buildDependencies(chartPath string, repositoryConfigName string) {
+	dependencies := ReadChartYaml(chartPath)["dependencies"]
+	if dependencies == nil || len(dependencies.([]interface{})) <= 0 {
+		log.Println("No dependencies found.")
+		return
+	}
+	log.Println("Dependencies found.")
+
+	log.Println("Generating repository config...")
+	sysArgs := []string{"dependency", "build", "--repository-config", repositoryConfigName}
+	var stderr bytes.Buffer
+	sysCmd := exec.Command("helm", sysArgs...)
+	sysCmd.Dir = chartPath
+	sysCmd.Stderr = &stderr
+	if err := sysCmd.Run(); err != nil {
+		log.Printf("Error running helm dependency build: %s\n%s", err, stderr.String())
+	}
+}
 
-		isDependency := false
-		dependencies := chartYaml["dependencies"]
-		if dependencies == nil || len(dependencies.([]interface{})) <= 0 {
-			log.Println("No dependencies found.")
-		} else {
-			isDependency = true
-			log.Println("Dependencies found.")
+// valuesArgs writes the values of a source in valuesDir, once decrypted and
+// substituted, and returns the helm template arguments setting them. As in
+// ArgoCD, the value files are overridden by helm.valuesObject, or
+// helm.values when unset, then by the parameters and the file parameters.
+func (builder *Builder) valuesArgs(source Source, chartPath string, valuesDir string, manifestDir string, refs map[string]string, chain *ProviderChain, application Application) ([]string, error) {
+	var errs []error
+	var args []string
+	for i, valueFile := range source.Helm.ValueFiles {
+		filePath, err := valueFilePath(valueFile, refs, manifestDir, chartPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		content, err := os.ReadFile(filePath)
+		if os.IsNotExist(err) && source.Helm.IgnoreMissingValueFiles {
+			log.Printf("Value file %s not found, skipping...", valueFile)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("read value file %s: %w", valueFile, err))
+			continue
 		}
 
-		if isDependency {
-			log.Println("Generating repository config...")
-			os.Chdir(tempDir + "/" + application.Spec.Source.Chart)
-			sysArgs = []string{"dependency", "build", "--repository-config", repoConfigPath + application.Metadata.Name + ".yaml"}
-			sysCmd = exec.Command(sysCommand, sysArgs...)
-			sysCmd.Run()
+		values, err := builder.applyEnvOnValuesFile(content, valueFile, chain, application)
+		if err != nil {
+			errs = append(errs, prefixErrors(valueFile, err))
+			continue
 		}
 
-		overrideValuesPath := ""
-		// if Values override is set, create a file override.values.yaml
-		if application.Spec.Source.Helm.Values != "" {
-			log.Println("Values file found, will use it to override values.")
+		valuesPath := fmt.Sprintf("%s/override.values-%d.yaml", valuesDir, i)
+		if err := os.WriteFile(valuesPath, values, 0600); err != nil {
+			errs = append(errs, fmt.Errorf("write value file %s: %w", valueFile, err))
+			continue
+		}
+		args = append(args, "--values", valuesPath)
+	}
 
-			overrideValuesPath = fmt.Sprintf("%s/override.values.yaml", chartPath)
-			err = os.WriteFile(overrideValuesPath, applyEnvOnValues([]byte(application.Spec.Source.Helm.Values)), 0600)
-			if err != nil {
-				log.Fatalf("Error writing override values: %v", err)
-			}
+	// if Values override is set, create a file override.values.yaml
+	values, valuesName := []byte(source.Helm.Values), "helm.values"
+	if source.Helm.ValuesObject != nil {
+		valuesName = "helm.valuesObject"
+		bs, err := yaml.Marshal(source.Helm.ValuesObject)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("marshal %s: %w", valuesName, err))
 		}
+		values = bs
+	}
+	if len(values) > 0 {
+		log.Println("Values file found, will use it to override values.")
 
-		sysArgs = []string{"template", application.Metadata.Name, chartPath}
-		if application.Spec.Destination.Namespace == "" {
-			sysArgs = append(sysArgs, "--namespace", os.Getenv("ARGOCD_APP_NAMESPACE"))
+		values, err := builder.applyEnvOnValuesFile(values, valuesName, chain, application)
+		if err != nil {
+			errs = append(errs, prefixErrors(valuesName, err))
 		} else {
-			sysArgs = append(sysArgs, "--namespace", application.Spec.Destination.Namespace)
+			overrideValuesPath := fmt.Sprintf("%s/override.values.yaml", valuesDir)
+			if err := os.WriteFile(overrideValuesPath, values, 0600); err != nil {
+				errs = append(errs, fmt.Errorf("write %s: %w", valuesName, err))
+			} else {
+				args = append(args, "--values", overrideValuesPath)
+			}
 		}
+	}
 
-		if overrideValuesPath != "" {
-			sysArgs = append(sysArgs, "--values", overrideValuesPath)
+	for _, parameter := range source.Helm.Parameters {
+		value, err := builder.substituteText([]byte(parameter.Value), chain, application)
+		if err != nil {
+			errs = append(errs, prefixErrors("parameter "+parameter.Name, err))
+			continue
+		}
+		flag := "--set"
+		if parameter.ForceString {
+			flag = "--set-string"
 		}
+		args = append(args, flag, parameter.Name+"="+escapeSetValue(string(value)))
+	}
 
-		sysCmd = exec.Command(sysCommand, sysArgs...)
-		sysCmd.Stdout = &out
-		sysCmd.Stderr = &stderr
-		err = sysCmd.Run()
+	for i, parameter := range source.Helm.FileParameters {
+		filePath, err := valueFilePath(parameter.Path, refs, manifestDir, chartPath)
 		if err != nil {
-			log.Fatalf("Error running helm template: %s\n%s", err, stderr.String())
+			errs = append(errs, fmt.Errorf("file parameter %s: %w", parameter.Name, err))
+			continue
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("read file parameter %s: %w", parameter.Name, err))
+			continue
 		}
-		fmt.Println(out.String())
 
-		buildPath := fmt.Sprintf("%s/%s/build.yaml", tempDir, application.Metadata.Name)
-		err = os.WriteFile(buildPath, out.Bytes(), 0600)
+		value, err := builder.substituteText(content, chain, application)
 		if err != nil {
-			log.Fatalf("Error writing override values: %v", err)
+			errs = append(errs, prefixErrors(parameter.Path, err))
+			continue
 		}
+
+		parameterPath := fmt.Sprintf("%s/override.file-%d", valuesDir, i)
+		if err := os.WriteFile(parameterPath, value, 0600); err != nil {
+			errs = append(errs, fmt.Errorf("write file parameter %s: %w", parameter.Name, err))
+			continue
+		}
+		args = append(args, "--set-file", parameter.Name+"="+parameterPath)
 	}
+	return args, errors.Join(errs...)
+}
 
-	//	log.Fatal("stop here")
+// substituteText substitutes a value that is not a YAML document, such as
+// a parameter, ignoring the yaml mode and the paths of the Application.
+func (builder *Builder) substituteText(value []byte, chain *ProviderChain, application Application) ([]byte, error) {
+	options := substitutionOptions(builder.Config, application, builder.Strict)
+	options.Mode = TextMode
+	options.Paths = nil
+	return applyEnvOnValues(value, chain, options)
+}
 
-	// Use app name as config file name
-	// repositoryConfigName := repoConfigPath + chartYaml["name"].(string) + ".yaml"
-	// log.Printf("repositoryConfigName: %s\n", repositoryConfigName)
+// escapeSetValue escapes the commas of a --set value, which helm reads as
+// separators, unless the value is a {a,b} list. ArgoCD does the same.
+func escapeSetValue(value string) string {
+	if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
+		return value
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == ',' && (i == 0 || value[i-1] != '\\') {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(value[i])
+	}
+	return escaped.String()
+}
 
-	// log.Println("Generating repository config...")
-	// builder.generateRepositoryConfig(repositoryConfigName, chartYaml, helmRegistrySecretConfigPath)
+// template renders a chart with helm template.
+func (builder *Builder) template(application Application, source Source, chartPath string, valuesArgs []string) []byte {
+	releaseName := source.Helm.ReleaseName
+	if len(releaseName) <= 0 {
+		releaseName = application.Metadata.Name
+	}
+	namespace := source.Helm.Namespace
+	if len(namespace) <= 0 {
+		namespace = application.Spec.Destination.Namespace
+	}
+	if len(namespace) <= 0 {
+		namespace = os.Getenv("ARGOCD_APP_NAMESPACE")
+	}
 
-	// log.Println("Executing helm dependency build...")
-	// builder.executeHelmDependencyBuild(repositoryConfigName)
+	sysArgs := []string{"template", releaseName, chartPath, "--namespace", namespace}
+	// ArgoCD renders the CRDs of the chart unless skipCrds is set
+	if !source.Helm.SkipCrds {
+		sysArgs = append(sysArgs, "--include-crds")
+	}
+	sysArgs = append(sysArgs, valuesArgs...)
 
-	// log.Println("Build process completed.")
+	var out, stderr bytes.Buffer
+	sysCmd := exec.Command("helm", sysArgs...)
+	sysCmd.Stdout = &out
+	sysCmd.Stderr = &stderr
+	err := sysCmd.Run()
+	if err != nil {
+		log.Fatalf("Error running helm template: %s\n%s", err, stderr.String())
+	}
+	return out.Bytes()
+}
+
+// pullOCIChart extracts the chart of an OCI source in dir, and returns the
+// digest of its manifest. The targetRevision is a version, a constraint
+// resolved against the tags of the repository, or a digest, optionally
+// following a version ("1.2.3@sha256:...").
+func (builder *Builder) pullOCIChart(source Source, dir string, username string, password string) string {
+	ref, err := parseOCIReference(source.RepoURL, source.Chart)
+	if err != nil {
+		log.Fatalf("Error parsing OCI source: %v", err)
+	}
+	registry := &ociRegistry{host: ref.host, username: username, password: password}
+
+	version, digest, err := splitDigest(source.TargetRevision)
+	if err != nil {
+		log.Fatalf("Error parsing targetRevision: %v", err)
+	}
+	reference := digest
+	if len(reference) <= 0 {
+		if len(version) <= 0 {
+			log.Fatalf("Error pulling %s: OCI charts need a targetRevision", source.Chart)
+		}
+		if reference, err = registry.resolveChartVersion(ref, version); err != nil {
+			log.Fatalf("Error resolving chart version: %v", err)
+		}
+	}
+
+	log.Printf("Pulling %s/%s@%s", ref.host, ref.repository, reference)
+	pulled, err := registry.pull(ref, reference, dir)
+	if err != nil {
+		log.Fatalf("Error pulling OCI chart: %v", err)
+	}
+
+	// A version pinned to a digest must be the version of the chart
+	if len(digest) > 0 && len(version) > 0 {
+		chartVersion := fmt.Sprint(ReadChartYaml(filepath.Join(dir, path.Base(source.Chart)))["version"])
+		if chartVersion != version {
+			log.Fatalf("Error pulling %s: digest %s is version %s, not %s", source.Chart, digest, chartVersion, version)
+		}
+	}
+	return pulled
 }
 
 func (builder *Builder) generateRepositoryConfig(repositoryConfigName string, chartYaml map[string]interface{}, helmRegistrySecretConfigPath string) {
@@ -273,7 +648,9 @@ func (builder *Builder) generateRepositoryConfig(repositoryConfigName string, ch
 	if err != nil {
 		log.Fatalf("Marshal helm repository yaml error: %v", err)
 	}
-	fmt.Println(string(yamlConfig))
+	for _, repo := range repos {
+		log.Printf("Repository %s: %s", repo.Name, repo.Url)
+	}
 
 	err = os.WriteFile(repositoryConfigName, []byte(yamlConfig), 0777)
 	if err != nil {
@@ -296,7 +673,10 @@ func (builder *Builder) readRepositoryConfig(repositoryUrl string, helmRegistryS
 
 	// Return the username password if url matches
 	for _, r := range repo.Repositories {
-		if r.Url == repositoryUrl {
+		redactor.Add(r.Password)
+	}
+	for _, r := range repo.Repositories {
+		if sameChartRepository(r.Url, repositoryUrl) {
 			return r.Username, r.Password
 		}
 	}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestValuesArgs(t *testing.T) {
+	t.Setenv("ARGOCD_ENV_DOMAIN", "app.example.com")
+	t.Setenv("ARGOCD_ENV_HOSTS", "a.example.com,b.example.com")
+
+	manifestDir := t.TempDir()
+	chartPath := t.TempDir()
+	files := map[string]string{
+		filepath.Join(manifestDir, "values.yaml"): "domain: ${DOMAIN}\n",
+		filepath.Join(manifestDir, "ca.crt"):      "CN=${DOMAIN}\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest := `spec:
+  source:
+    helm:
+      ignoreMissingValueFiles: true
+      valueFiles:
+        - values.yaml
+        - values-missing.yaml
+      values: |
+        ignored: true
+      valuesObject:
+        ingress:
+          host: ${DOMAIN}
+      parameters:
+        - name: hosts
+          value: ${HOSTS}
+        - name: replicas
+          value: "2"
+          forceString: true
+      fileParameters:
+        - name: ca
+          path: ca.crt
+`
+	application := Application{}
+	if err := yaml.Unmarshal([]byte(manifest), &application); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultPluginConfig()
+	builder := &Builder{Config: config}
+	args, err := builder.valuesArgs(application.Spec.Source, chartPath, chartPath, manifestDir, nil, newTestProviderChain(t, config), application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"--values", filepath.Join(chartPath, "override.values-0.yaml"),
+		"--values", filepath.Join(chartPath, "override.values.yaml"),
+		"--set", `hosts=a.example.com\,b.example.com`,
+		"--set-string", "replicas=2",
+		"--set-file", "ca=" + filepath.Join(chartPath, "override.file-0"),
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("got %q, want %q", args, want)
+	}
+
+	written := map[string]string{
+		"override.values-0.yaml": "domain: app.example.com\n",
+		"override.values.yaml":   "ingress:\n  host: app.example.com\n",
+		"override.file-0":        "CN=app.example.com\n",
+	}
+	for name, content := range written {
+		bs, err := os.ReadFile(filepath.Join(chartPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != content {
+			t.Errorf("%s: got %q, want %q", name, bs, content)
+		}
+	}
+}
+
+func TestValuesArgsOutside(t *testing.T) {
+	root := t.TempDir()
+	manifestDir := filepath.Join(root, "apps")
+	if err := os.MkdirAll(filepath.Join(root, ".git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(manifestDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	chartPath := t.TempDir()
+
+	token := "../../../var/run/secrets/kubernetes.io/serviceaccount/token"
+	sources := []Source{
+		{Helm: Helm{ValueFiles: []string{token}}},
+		{Helm: Helm{FileParameters: []HelmFileParameter{{Name: "token", Path: token}}}},
+	}
+	config := DefaultPluginConfig()
+	builder := &Builder{Config: config}
+	for _, source := range sources {
+		_, err := builder.valuesArgs(source, chartPath, t.TempDir(), manifestDir, nil, newTestProviderChain(t, config), Application{})
+		if err == nil || !strings.Contains(err.Error(), "outside of the repository") {
+			t.Errorf("got error %v, want %s to be rejected", err, token)
+		}
+	}
+}
+
+func TestValuesArgsErrors(t *testing.T) {
+	manifestDir := t.TempDir()
+	source := Source{Helm: Helm{
+		ValueFiles: []string{"values-missing.yaml"},
+		Values:     "domain: ${MISSING_DOMAIN}\n",
+	}}
+	config := DefaultPluginConfig()
+	builder := &Builder{Config: config, Strict: true}
+	_, err := builder.valuesArgs(source, t.TempDir(), t.TempDir(), manifestDir, nil, newTestProviderChain(t, config), Application{})
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"read value file values-missing.yaml", "helm.values: "} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want it to contain %q", err, want)
+		}
+	}
+
+	source.Helm.ValueFiles = nil
+	source.Helm.ValuesObject = map[string]interface{}{"domain": "${MISSING_DOMAIN}"}
+	_, err = builder.valuesArgs(source, t.TempDir(), t.TempDir(), manifestDir, nil, newTestProviderChain(t, config), Application{})
+	if err == nil || !strings.Contains(err.Error(), "helm.valuesObject: ") {
+		t.Errorf("got error %v, want it to name helm.valuesObject", err)
+	}
+}
+
+func TestEscapeSetValue(t *testing.T) {
+	tests := map[string]string{
+		"a,b":       `a\,b`,
+		`a\,b`:      `a\,b`,
+		"{a,b}":     "{a,b}",
+		"no commas": "no commas",
+	}
+	for value, want := range tests {
+		if got := escapeSetValue(value); got != want {
+			t.Errorf("%s: got %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestLocalChart(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		filepath.Join(root, "charts", "app", "Chart.yaml"): "name: app\nversion: 1.0.0\n",
+		filepath.Join(root, "manifests", "app.yaml"):       "",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, ".git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	archive := chartArchive(t, map[string]string{"packaged/Chart.yaml": "name: packaged\nversion: 2.0.0\n"})
+	if err := os.WriteFile(filepath.Join(root, "charts", "packaged-2.0.0.tgz"), archive, 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifestDir := filepath.Join(root, "manifests")
+
+	builder := NewBuilder()
+	chartPath, info, err := builder.localChart(Source{Path: "charts/app"}, t.TempDir(), manifestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chartPath != filepath.Join(root, "charts", "app") || info.Chart != "app" || info.Version != "1.0.0" {
+		t.Errorf("unexpected chart %s %+v", chartPath, info)
+	}
+
+	dir := t.TempDir()
+	chartPath, info, err = builder.localChart(Source{Path: "charts/packaged-2.0.0.tgz"}, dir, manifestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chartPath != filepath.Join(dir, "packaged") || info.Chart != "packaged" || info.Version != "2.0.0" {
+		t.Errorf("unexpected chart %s %+v", chartPath, info)
+	}
+
+	if _, _, err := builder.localChart(Source{Path: "manifests"}, t.TempDir(), manifestDir); err == nil {
+		t.Error("expected a directory without Chart.yaml to be rejected")
+	}
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "Chart.yaml"), []byte("name: outside\nversion: 1.0.0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "charts", "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"../outside", "charts/link", "charts/missing.tgz"} {
+		if _, _, err := builder.localChart(Source{Path: path}, t.TempDir(), manifestDir); err == nil {
+			t.Errorf("expected %s to be rejected", path)
+		}
+	}
+
+	// A name starting with .. is not a parent directory
+	if err := os.MkdirAll(filepath.Join(root, "..charts"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := localSourcePath(Source{Path: "..charts"}, manifestDir); err != nil {
+		t.Error(err)
+	}
+}
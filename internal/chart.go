@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// buildInfoFile records, next to build.yaml, the chart versions a build
+// was rendered from.
+const buildInfoFile = "build-info.yaml"
+
+// chartRepositoryName names the repository of a chart source in the helm
+// repository config written to pull it.
+const chartRepositoryName = "envsubst"
+
+// BuildInfo is what a build was rendered from.
+type BuildInfo struct {
+	RepoURL string `yaml:"repoURL"`
+	Chart   string `yaml:"chart"`
+	// Path is the path of a chart of the repository
+	Path           string `yaml:"path,omitempty"`
+	TargetRevision string `yaml:"targetRevision"`
+	Version        string `yaml:"version"`
+	// Digest is the digest of the OCI manifest of the chart
+	Digest string `yaml:"digest,omitempty"`
+}
+
+// repositoryIndex is the part of the index.yaml of a Helm repository listing
+// the versions of its charts.
+type repositoryIndex struct {
+	Entries map[string][]struct {
+		Version string `yaml:"version"`
+	} `yaml:"entries"`
+
+	// raw is the index as downloaded, given to helm as its cache
+	raw []byte
+}
+
+// chartRepository downloads the index of a Helm repository.
+type chartRepository struct {
+	url        string
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+// resolveChartVersion returns the version of the chart to pull for a
+// targetRevision, see resolveVersion, and the index of the repository when
+// it had to be read.
+func (repository *chartRepository) resolveChartVersion(chart string, targetRevision string) (string, *repositoryIndex, error) {
+	var index *repositoryIndex
+	version, err := resolveVersion(targetRevision, func() ([]string, error) {
+		var err error
+		index, err = repository.index()
+		if err != nil {
+			return nil, err
+		}
+		var versions []string
+		for _, entry := range index.Entries[chart] {
+			versions = append(versions, entry.Version)
+		}
+		return versions, nil
+	}, fmt.Sprintf("%s in %s", chart, repository.url))
+	return version, index, err
+}
+
+// resolveVersion returns the version to pull for a targetRevision: the
+// revision itself when it is an exact version, the highest of the listed
+// versions matching it when it is a constraint such as ~1.2 or
+// ">=0.3 <0.4", and an empty string for the latest version.
+func resolveVersion(targetRevision string, list func() ([]string, error), chart string) (string, error) {
+	targetRevision = strings.TrimSpace(targetRevision)
+	if targetRevision == "" {
+		return "", nil
+	}
+	if _, err := semver.StrictNewVersion(targetRevision); err == nil {
+		return targetRevision, nil
+	}
+
+	constraint, err := semver.NewConstraint(targetRevision)
+	if err != nil {
+		return "", fmt.Errorf("targetRevision %q is neither a version nor a constraint: %w", targetRevision, err)
+	}
+	versions, err := list()
+	if err != nil {
+		return "", err
+	}
+
+	var resolved *semver.Version
+	var original string
+	for _, v := range versions {
+		version, err := semver.NewVersion(v)
+		if err != nil || !constraint.Check(version) {
+			continue
+		}
+		if resolved == nil || version.GreaterThan(resolved) {
+			resolved, original = version, v
+		}
+	}
+	if resolved == nil {
+		return "", fmt.Errorf("no version of %s matches %s", chart, targetRevision)
+	}
+	return original, nil
+}
+
+func (repository *chartRepository) index() (*repositoryIndex, error) {
+	bs, err := repository.indexBytes()
+	if err != nil {
+		return nil, err
+	}
+	index := repositoryIndex{raw: bs}
+	if err := yaml.Unmarshal(bs, &index); err != nil {
+		return nil, fmt.Errorf("unmarshal index of %s: %w", repository.url, err)
+	}
+	return &index, nil
+}
+
+func (repository *chartRepository) indexBytes() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(repository.url, "/")+"/index.yaml", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(repository.username) > 0 || len(repository.password) > 0 {
+		req.SetBasicAuth(repository.username, repository.password)
+	}
+
+	httpClient := repository.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get index of %s: %w", repository.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get index of %s: %s", repository.url, resp.Status)
+	}
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read index of %s: %w", repository.url, err)
+	}
+	return bs, nil
+}
+
+// helmConfig writes in dir a helm repository config holding the
+// credentials of the repository, and a cache holding its index, and returns
+// the helm arguments using them. The credentials are then not on the
+// command line of helm, where every process of the sidecar could read them.
+// The index is downloaded when not given.
+func (repository *chartRepository) helmConfig(dir string, index *repositoryIndex, passCredentials bool) ([]string, error) {
+	if index == nil {
+		var err error
+		if index, err = repository.index(); err != nil {
+			return nil, err
+		}
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, chartRepositoryName+"-index.yaml"), index.raw, 0600); err != nil {
+		return nil, err
+	}
+
+	config, err := yaml.Marshal(HelmRepositoryConfig{
+		Generated: "0001-01-01T00:00:00Z",
+		Repositories: []Repository{{
+			Name:               chartRepositoryName,
+			Url:                repository.url,
+			Username:           repository.username,
+			Password:           repository.password,
+			PassCredentialsAll: passCredentials,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	configPath := filepath.Join(dir, "repositories.yaml")
+	if err := os.WriteFile(configPath, config, 0600); err != nil {
+		return nil, err
+	}
+	return []string{"--repository-config", configPath, "--repository-cache", cacheDir}, nil
+}
+
+// sameChartRepository compares the URL of a chart repository with the url
+// of the repository config, ignoring the oci:// scheme, which the config of
+// an OCI registry may omit, and the trailing slash. Other schemes, such as
+// https://, must match.
+func sameChartRepository(a string, b string) bool {
+	normalize := func(url string) string {
+		return strings.TrimRight(strings.TrimPrefix(url, ociScheme), "/")
+	}
+	return normalize(a) == normalize(b)
+}
+
+// writeBuildInfo records the charts a build was rendered from, one per
+// chart source.
+func writeBuildInfo(path string, infos []BuildInfo) error {
+	bs, err := yaml.Marshal(infos)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, bs, 0600)
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestResolveChartVersion(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if username, password, _ := r.BasicAuth(); username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/charts/index.yaml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`apiVersion: v1
+entries:
+  cloudflare-tunnel:
+    - version: 0.4.0
+    - version: 0.3.10
+    - version: 0.3.2
+    - version: 0.3.11-rc.1
+    - version: 1.2.7
+    - version: 1.2.3
+    - version: 1.3.0
+  other:
+    - version: 9.9.9
+`))
+	}))
+	defer server.Close()
+
+	repository := &chartRepository{url: server.URL + "/charts/", username: "user", password: "pass"}
+	tests := map[string]string{
+		"":            "",
+		"0.3.2":       "0.3.2",
+		"0.3.99":      "0.3.99",
+		"~1.2":        "1.2.7",
+		">=0.3 <0.4":  "0.3.10",
+		"^0.3.0":      "0.3.10",
+		"*":           "1.3.0",
+		">=0.3.11-rc": "1.3.0",
+	}
+	for targetRevision, want := range tests {
+		got, _, err := repository.resolveChartVersion("cloudflare-tunnel", targetRevision)
+		if err != nil {
+			t.Errorf("%q: %v", targetRevision, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: got %q, want %q", targetRevision, got, want)
+		}
+	}
+	if requests != 5 {
+		t.Errorf("expected the index to be read for the constraints only, got %d requests", requests)
+	}
+
+	for _, targetRevision := range []string{">=2.0", "not a version"} {
+		if _, _, err := repository.resolveChartVersion("cloudflare-tunnel", targetRevision); err == nil {
+			t.Errorf("expected %q to fail", targetRevision)
+		}
+	}
+	repository.password = "wrong"
+	if _, _, err := repository.resolveChartVersion("cloudflare-tunnel", "~1.2"); err == nil {
+		t.Error("expected the authentication to fail")
+	}
+}
+
+func TestChartRepositoryHelmConfig(t *testing.T) {
+	index := "apiVersion: v1\nentries:\n  app:\n    - version: 1.0.0\n"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if username, password, _ := r.BasicAuth(); username != "user" || password != "s3cr3t-pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(index))
+	}))
+	defer server.Close()
+
+	repository := &chartRepository{url: server.URL, username: "user", password: "s3cr3t-pass"}
+	version, resolved, err := repository.resolveChartVersion("app", "^1.0")
+	if err != nil || version != "1.0.0" {
+		t.Fatalf("got version %q: %v", version, err)
+	}
+	dir := t.TempDir()
+	args, err := repository.helmConfig(dir, resolved, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected the index read to resolve the version to be reused, got %d requests", requests)
+	}
+	if strings.Contains(strings.Join(args, " "), "s3cr3t-pass") {
+		t.Errorf("the password is on the command line: %v", args)
+	}
+
+	bs, err := os.ReadFile(filepath.Join(dir, "repositories.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := HelmRepositoryConfig{}
+	if err := yaml.Unmarshal(bs, &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Repositories) != 1 || config.Repositories[0].Name != chartRepositoryName || config.Repositories[0].Password != "s3cr3t-pass" || !config.Repositories[0].PassCredentialsAll {
+		t.Errorf("unexpected repository config %+v", config)
+	}
+	if bs, err := os.ReadFile(filepath.Join(dir, "cache", chartRepositoryName+"-index.yaml")); err != nil || string(bs) != index {
+		t.Errorf("unexpected cached index %q: %v", bs, err)
+	}
+}
+
+func TestReadRepositoryConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "repositories.yaml")
+	config := `repositories:
+  - name: ghcr
+    url: ghcr.io/org/charts/
+    username: ghcr-user
+    password: ghcr-pass
+  - name: harbor
+    url: oci://harbor.example.com/library
+    username: harbor-user
+    password: harbor-pass
+  - name: charts
+    url: https://charts.example.com/
+    username: charts-user
+    password: charts-pass
+`
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"oci://ghcr.io/org/charts":          "ghcr-user",
+		"oci://harbor.example.com/library/": "harbor-user",
+		"harbor.example.com/library":        "harbor-user",
+		"https://charts.example.com":        "charts-user",
+		"http://charts.example.com":         "",
+		"oci://ghcr.io/org":                 "",
+	}
+	builder := NewBuilder()
+	for repoURL, want := range tests {
+		if username, _ := builder.readRepositoryConfig(repoURL, configPath); username != want {
+			t.Errorf("%s: got %q, want %q", repoURL, username, want)
+		}
+	}
+}
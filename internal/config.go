@@ -0,0 +1,337 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// pluginConfigEnv overrides the path of the plugin config file
+	pluginConfigEnv = "ENVSUBST_PLUGIN_CONFIG"
+	// allowEnv and denyEnv override the variable policy of the config file,
+	// as a comma separated list of rules (e.g. "prefix:APP_,name:REGION")
+	allowEnv = "ENVSUBST_ALLOW"
+	denyEnv  = "ENVSUBST_DENY"
+
+	envProviderType = "env"
+	// argocdEnvProviderName names the plugin env of the Application in the
+	// logs, it is part of the env provider
+	argocdEnvProviderName = "argocd-env"
+	fileProviderType      = "file"
+
+	fileReferenceScheme       = "file"
+	kubernetesReferenceScheme = "k8s"
+	vaultReferenceScheme      = "vault"
+)
+
+var (
+	defaultPluginConfigPath = "/helm-working-dir/plugin-config.yaml"
+)
+
+// PluginConfig is the configuration shared by every command of the plugin.
+type PluginConfig struct {
+	Variables    VariablePolicy     `yaml:"variables"`
+	Substitution SubstitutionConfig `yaml:"substitution"`
+	// Providers is the chain of sources the variables are resolved from, in
+	// order of precedence
+	Providers  []ProviderConfig `yaml:"providers"`
+	References ReferencesConfig `yaml:"references"`
+	SOPS       SOPSConfig       `yaml:"sops"`
+	Dotenv     DotenvConfig     `yaml:"dotenv"`
+}
+
+// DotenvConfig configures the dotenv files read by the env provider.
+type DotenvConfig struct {
+	// DefaultFile is read before the dotenv files of the Applications. A
+	// relative path is taken from the root of the git repository.
+	DefaultFile string `yaml:"defaultFile"`
+}
+
+// SOPSConfig configures the decryption of the values encrypted with SOPS.
+type SOPSConfig struct {
+	// AgeKeyFile holds the age keys, in addition to $SOPS_AGE_KEY and the
+	// file at $SOPS_AGE_KEY_FILE
+	AgeKeyFile string `yaml:"ageKeyFile"`
+}
+
+// ReferencesConfig configures the placeholders referencing a value by its
+// location, e.g. #file:/path#.
+type ReferencesConfig struct {
+	File  FileReferencesConfig       `yaml:"file"`
+	K8s   KubernetesReferencesConfig `yaml:"k8s"`
+	Vault VaultReferencesConfig      `yaml:"vault"`
+}
+
+// FileReferencesConfig restricts the files the #file:/path# placeholders
+// can read. No file can be read when AllowedDirs is empty.
+type FileReferencesConfig struct {
+	AllowedDirs []string `yaml:"allowedDirs"`
+}
+
+// KubernetesReferencesConfig enables the #k8s:secret/namespace/name/key#
+// placeholders, read with the service account of the plugin.
+type KubernetesReferencesConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Namespaces lists the namespaces that can be read, none when empty
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// VaultReferencesConfig enables the #vault:path#key# placeholders, read
+// from a Vault KV secrets engine.
+type VaultReferencesConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Address defaults to $VAULT_ADDR
+	Address   string `yaml:"address"`
+	Namespace string `yaml:"namespace"`
+	CACert    string `yaml:"caCert"`
+	// KVVersion forces the version of the KV engine, detected when 0
+	KVVersion int             `yaml:"kvVersion"`
+	Auth      VaultAuthConfig `yaml:"auth"`
+}
+
+// VaultAuthConfig tells how to get a Vault token.
+type VaultAuthConfig struct {
+	// Method is kubernetes or token, the latter reading $VAULT_TOKEN.
+	// Defaults to token when $VAULT_TOKEN is set, kubernetes otherwise.
+	Method string `yaml:"method"`
+	// Role, Mount and TokenPath configure the kubernetes method, Mount
+	// defaulting to kubernetes and TokenPath to the service account token
+	Role      string `yaml:"role"`
+	Mount     string `yaml:"mount"`
+	TokenPath string `yaml:"tokenPath"`
+}
+
+// ProviderConfig declares a value provider.
+type ProviderConfig struct {
+	// Type is the kind of provider: env or file
+	Type string `yaml:"type"`
+	// Path is the directory holding one file per variable, for the file provider
+	Path string `yaml:"path,omitempty"`
+}
+
+// SubstitutionConfig holds the substitution defaults, which Applications can
+// override with annotations.
+type SubstitutionConfig struct {
+	Mode SubstitutionMode `yaml:"mode"`
+	AVP  AVPConfig        `yaml:"avp"`
+	// Delimiters is a comma separated list of OPEN..CLOSE pairs, default to
+	// "${..},#..#"
+	Delimiters string `yaml:"delimiters"`
+	// Paths restricts the substitution to some YAML paths of the documents,
+	// e.g. .cloudflare.*
+	Paths []string `yaml:"paths"`
+}
+
+// AVPConfig enables the argocd-vault-plugin placeholders, <path:...#key>
+// and <key>, resolved with the reference provider of the backend.
+type AVPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Backend is vault (default) or k8s
+	Backend string `yaml:"backend"`
+}
+
+// VariablePolicy restricts the variables that can be substituted. A variable
+// is exposed when it matches at least one allow rule and no deny rule.
+type VariablePolicy struct {
+	Allow []VariableRule `yaml:"allow"`
+	Deny  []VariableRule `yaml:"deny"`
+}
+
+// VariableRule matches a variable name, either exactly, by prefix or with a
+// regular expression matched against the whole name. Only one of them can be set.
+type VariableRule struct {
+	Name   string `yaml:"name,omitempty"`
+	Prefix string `yaml:"prefix,omitempty"`
+	Regex  string `yaml:"regex,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// DefaultPluginConfig only exposes the variables set by ArgoCD from the
+// plugin env of the Application.
+func DefaultPluginConfig() *PluginConfig {
+	return &PluginConfig{
+		Variables: VariablePolicy{
+			Allow: []VariableRule{{Prefix: argocdEnvVarPrefix + "_"}},
+		},
+		Substitution: SubstitutionConfig{
+			Mode: TextMode,
+			AVP:  AVPConfig{Backend: vaultReferenceScheme},
+		},
+		Providers: []ProviderConfig{{Type: envProviderType}},
+		Dotenv:    DotenvConfig{DefaultFile: "envsubst.defaults.env"},
+	}
+}
+
+// LoadPluginConfig reads the plugin config file. When path is empty, the path
+// is taken from $ENVSUBST_PLUGIN_CONFIG, then from the default location where
+// a missing file simply means the defaults are used.
+func LoadPluginConfig(path string) (*PluginConfig, error) {
+	config := DefaultPluginConfig()
+
+	if len(path) <= 0 {
+		path = os.Getenv(pluginConfigEnv)
+	}
+	optional := false
+	if len(path) <= 0 {
+		path = defaultPluginConfigPath
+		optional = true
+	}
+
+	bs, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		fileConfig := PluginConfig{}
+		if err := yaml.UnmarshalStrict(bs, &fileConfig); err != nil {
+			return nil, fmt.Errorf("unmarshal %s: %w", path, err)
+		}
+		if len(fileConfig.Variables.Allow) <= 0 {
+			fileConfig.Variables.Allow = config.Variables.Allow
+		}
+		if len(fileConfig.Providers) <= 0 {
+			fileConfig.Providers = config.Providers
+		}
+		if len(fileConfig.Dotenv.DefaultFile) <= 0 {
+			fileConfig.Dotenv.DefaultFile = config.Dotenv.DefaultFile
+		}
+		config = &fileConfig
+	case !(optional && errors.Is(err, os.ErrNotExist)):
+		return nil, fmt.Errorf("read plugin config: %w", err)
+	}
+
+	if rules, ok := os.LookupEnv(allowEnv); ok {
+		if config.Variables.Allow, err = parseVariableRules(rules); err != nil {
+			return nil, fmt.Errorf("%s: %w", allowEnv, err)
+		}
+	}
+	if rules, ok := os.LookupEnv(denyEnv); ok {
+		if config.Variables.Deny, err = parseVariableRules(rules); err != nil {
+			return nil, fmt.Errorf("%s: %w", denyEnv, err)
+		}
+	}
+
+	if err := config.Variables.compile(); err != nil {
+		return nil, err
+	}
+	if config.Substitution.Mode, err = parseSubstitutionMode(string(config.Substitution.Mode)); err != nil {
+		return nil, err
+	}
+	if len(config.Substitution.Delimiters) > 0 {
+		if _, err := parseDelimiters(config.Substitution.Delimiters); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range config.Substitution.Paths {
+		if _, err := parseYAMLPath(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, provider := range config.Providers {
+		if err := provider.validate(); err != nil {
+			return nil, err
+		}
+	}
+	switch config.Substitution.AVP.Backend {
+	case "":
+		config.Substitution.AVP.Backend = vaultReferenceScheme
+	case vaultReferenceScheme, kubernetesReferenceScheme:
+	default:
+		return nil, fmt.Errorf("avp: unknown backend %q, expected %s or %s", config.Substitution.AVP.Backend, vaultReferenceScheme, kubernetesReferenceScheme)
+	}
+	if kv := config.References.Vault.KVVersion; kv != 0 && kv != 1 && kv != 2 {
+		return nil, fmt.Errorf("vault references: kvVersion must be 1 or 2")
+	}
+	for _, dir := range config.References.File.AllowedDirs {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("file references: allowed directory %s is not an absolute path", dir)
+		}
+	}
+	return config, nil
+}
+
+// parseVariableRules parses a comma separated list of "name:", "prefix:" or
+// "regex:" rules.
+func parseVariableRules(rules string) ([]VariableRule, error) {
+	parsed := []VariableRule{}
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		kind, value, _ := strings.Cut(rule, ":")
+		switch kind {
+		case "name":
+			parsed = append(parsed, VariableRule{Name: value})
+		case "prefix":
+			parsed = append(parsed, VariableRule{Prefix: value})
+		case "regex":
+			parsed = append(parsed, VariableRule{Regex: value})
+		default:
+			return nil, fmt.Errorf("invalid rule %q, expected name:, prefix: or regex:", rule)
+		}
+	}
+	return parsed, nil
+}
+
+func (policy *VariablePolicy) compile() error {
+	for _, rules := range [][]VariableRule{policy.Allow, policy.Deny} {
+		for i := range rules {
+			rule := &rules[i]
+			set := 0
+			for _, field := range []string{rule.Name, rule.Prefix, rule.Regex} {
+				if field != "" {
+					set++
+				}
+			}
+			if set != 1 {
+				return fmt.Errorf("variable rule %+v must set exactly one of name, prefix or regex", *rule)
+			}
+			if rule.Regex != "" {
+				regex, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+				if err != nil {
+					return fmt.Errorf("variable rule regex %q: %w", rule.Regex, err)
+				}
+				rule.regex = regex
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed tells whether the variable can be substituted.
+func (policy *VariablePolicy) Allowed(name string) bool {
+	return matchVariableRules(policy.Allow, name) && !matchVariableRules(policy.Deny, name)
+}
+
+func matchVariableRules(rules []VariableRule, name string) bool {
+	for _, rule := range rules {
+		switch {
+		case rule.Name != "" && rule.Name == name:
+			return true
+		case rule.Prefix != "" && strings.HasPrefix(name, rule.Prefix):
+			return true
+		case rule.regex != nil && rule.regex.MatchString(name):
+			return true
+		}
+	}
+	return false
+}
+
+func (provider ProviderConfig) validate() error {
+	switch provider.Type {
+	case envProviderType:
+	case fileProviderType:
+		if len(provider.Path) <= 0 {
+			return fmt.Errorf("%s provider: path is required", provider.Type)
+		}
+	default:
+		return fmt.Errorf("unknown provider type %q", provider.Type)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	app "github.com/qjoly/argocd-plugin-helm-envsubst/internal"
+)
+
+func TestDefaultVariablePolicy(t *testing.T) {
+	policy := app.DefaultPluginConfig().Variables
+
+	if !policy.Allowed("ARGOCD_ENV_DOMAIN") {
+		t.Error("ARGOCD_ENV_DOMAIN should be allowed")
+	}
+	for _, name := range []string{"ARGOCD_APP_NAME", "KUBERNETES_SERVICE_HOST", "AWS_SECRET_ACCESS_KEY"} {
+		if policy.Allowed(name) {
+			t.Errorf("%s should not be allowed", name)
+		}
+	}
+}
+
+func TestLoadPluginConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin-config.yaml")
+	config := `variables:
+  allow:
+    - prefix: APP_
+    - name: REGION
+    - regex: "TEAM_[0-9]+"
+  deny:
+    - name: APP_SECRET
+`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := app.LoadPluginConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := map[string]bool{
+		"APP_DOMAIN":        true,
+		"REGION":            true,
+		"TEAM_42":           true,
+		"APP_SECRET":        false,
+		"REGION_2":          false,
+		"MY_TEAM_42":        false,
+		"ARGOCD_ENV_DOMAIN": false,
+	}
+	for name, want := range allowed {
+		if got := loaded.Variables.Allowed(name); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestLoadPluginConfigFromEnv(t *testing.T) {
+	t.Setenv("ENVSUBST_PLUGIN_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := app.LoadPluginConfig(""); err == nil {
+		t.Error("expected an error for a missing config file set explicitly")
+	}
+
+	t.Setenv("ENVSUBST_PLUGIN_CONFIG", "")
+	t.Setenv("ENVSUBST_ALLOW", "prefix:ARGOCD_ENV_, name:REGION")
+	t.Setenv("ENVSUBST_DENY", "regex:.*PASSWORD.*")
+	loaded, err := app.LoadPluginConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Variables.Allowed("REGION") || loaded.Variables.Allowed("ARGOCD_ENV_DB_PASSWORD") {
+		t.Errorf("unexpected policy %+v", loaded.Variables)
+	}
+
+	t.Setenv("ENVSUBST_ALLOW", "suffix:_NAME")
+	if _, err := app.LoadPluginConfig(""); err == nil {
+		t.Error("expected an error for an invalid rule")
+	}
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const dotenvProviderType = "dotenv"
+
+// dotenvFiles are read next to the Application manifests, the latter taking
+// precedence.
+var dotenvFiles = []string{".env", "envsubst.env"}
+
+// dotenvKey matches the name of a variable in a dotenv file.
+var dotenvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// dotenvProvider resolves the variables of the dotenv files of the
+// Applications being processed. The variables are committed with the
+// manifests, so they are not restricted by the variable policy.
+type dotenvProvider struct {
+	defaultFile string
+	envs        map[string]string
+}
+
+func (provider *dotenvProvider) Name() string {
+	return dotenvProviderType
+}
+
+func (provider *dotenvProvider) Lookup(name string) (string, bool, error) {
+	value, ok := provider.envs[name]
+	return value, ok, nil
+}
+
+// load reads the dotenv files of the Applications of a directory: the
+// default file of the repository, then the files of the directory.
+func (provider *dotenvProvider) load(dir string) error {
+	var paths []string
+	if defaultFile := provider.defaultFile; len(defaultFile) > 0 {
+		if !filepath.IsAbs(defaultFile) {
+			root, ok := repositoryRoot(dir)
+			if ok {
+				paths = append(paths, filepath.Join(root, defaultFile))
+			}
+		} else {
+			paths = append(paths, defaultFile)
+		}
+	}
+	for _, name := range dotenvFiles {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+
+	envs := map[string]string{}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fileEnvs, err := parseDotenv(content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		log.Printf("Read %d variables from %s", len(fileEnvs), path)
+		for name, value := range fileEnvs {
+			envs[name] = value
+		}
+	}
+	provider.envs = envs
+	return nil
+}
+
+// repositoryRoot returns the root of the git repository holding dir.
+func repositoryRoot(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// parseDotenv parses the NAME=value lines of a dotenv file. Values can be
+// double quoted, with escape sequences, or single quoted, taken as is.
+// Errors only give the line, as the values may be secrets.
+func parseDotenv(content []byte) (map[string]string, error) {
+	envs := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+
+		name, value, ok := strings.Cut(text, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !dotenvKey.MatchString(name) {
+			return nil, fmt.Errorf("line %d: expected NAME=value", line)
+		}
+		value, err := dotenvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		envs[name] = value
+	}
+	return envs, scanner.Err()
+}
+
+func dotenvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch quote := value[0]; quote {
+	case '"', '\'':
+		end := strings.LastIndexByte(value, quote)
+		if end <= 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected content after quoted value")
+		}
+		value = value[1:end]
+		if quote == '\'' {
+			return value, nil
+		}
+		return strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(value), nil
+	}
+
+	// An unquoted value ends at a comment
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	content := `# Comment
+export DOMAIN=app.example.com
+REGION = eu-west-1 # inline comment
+EMPTY=
+QUOTED="line1\nline2 # kept"
+LITERAL='$HOME\n'
+`
+	got, err := parseDotenv([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"DOMAIN":  "app.example.com",
+		"REGION":  "eu-west-1",
+		"EMPTY":   "",
+		"QUOTED":  "line1\nline2 # kept",
+		"LITERAL": `$HOME\n`,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s: got %q, want %q", name, got[name], value)
+		}
+	}
+
+	for _, content := range []string{"NO_VALUE\n", "1NAME=value\n", "NAME=\"unterminated\n", "NAME=\"a\" b\n"} {
+		if _, err := parseDotenv([]byte(content)); err == nil {
+			t.Errorf("expected %q to be rejected", content)
+		}
+	}
+}
+
+func TestApplyEnvOnValuesDotenv(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "apps", "app")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, ".git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(root, "envsubst.defaults.env"): "DEFAULT=repo\nDOTENV=repo\nENVSUBST=repo\nARGOCD=repo\n",
+		filepath.Join(dir, ".env"):                   "DOTENV=dotenv\nENVSUBST=dotenv\nARGOCD=dotenv\n",
+		filepath.Join(dir, "envsubst.env"):           "ENVSUBST=envsubst\nARGOCD=envsubst\nSIDECAR=envsubst\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("ARGOCD_ENV_ARGOCD", "argocd")
+	t.Setenv("SIDECAR", "sidecar")
+	t.Setenv("PROCESS", "sidecar")
+
+	config := DefaultPluginConfig()
+	config.Variables.Allow = append(config.Variables.Allow, VariableRule{Name: "SIDECAR"}, VariableRule{Name: "PROCESS"})
+	chain := newTestProviderChain(t, config)
+	if err := chain.loadDotenv(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	values := "default: #DEFAULT#\ndotenv: #DOTENV#\nenvsubst: #ENVSUBST#\nargocd: #ARGOCD#\nsidecar: #SIDECAR#\nprocess: #PROCESS#\n"
+	want := "default: repo\ndotenv: dotenv\nenvsubst: envsubst\nargocd: argocd\nsidecar: envsubst\nprocess: sidecar\n"
+	got, err := applyEnvOnValues([]byte(values), chain, SubstitutionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if provider, _ := chain.ResolvedBy("ARGOCD"); provider != argocdEnvProviderName {
+		t.Errorf("ARGOCD resolved by %s, want %s", provider, argocdEnvProviderName)
+	}
+	if provider, _ := chain.ResolvedBy("SIDECAR"); provider != dotenvProviderType {
+		t.Errorf("SIDECAR resolved by %s, want %s", provider, dotenvProviderType)
+	}
+}
@@ -0,0 +1,474 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// placeholderName matches the variable names accepted inside a placeholder.
+var placeholderName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// maxExpansionDepth limits the nesting of variables whose value holds
+// placeholders, e.g. DB_URL=postgres://#DB_HOST#:#DB_PORT#/app.
+const maxExpansionDepth = 10
+
+// Lookup returns the value of a variable and whether it is set. An error
+// means the variable could not be looked up, not that it is missing.
+type Lookup func(name string) (string, bool, error)
+
+// Substituter replaces placeholders in a document. It understands:
+//
+//	#NAME#                 value of NAME, left untouched if NAME is not set
+//	${NAME}                value of NAME, left untouched if NAME is not set
+//	${NAME:-default}       value of NAME, or default if NAME is unset or empty
+//	${NAME:?error message} value of NAME, or an error if NAME is unset or empty
+//	$$                     a literal $ (so $${NAME} renders as ${NAME})
+//
+// Other delimiters can replace ${NAME} and #NAME#, e.g. @@NAME@@ or
+// {{env NAME}}. See parseDelimiters.
+//
+// Instead of a variable name, a placeholder can reference a value by its
+// location, e.g. #file:/var/run/secrets/app/password#. See isReference.
+//
+// A placeholder can end with a pipeline of filters, e.g. #TOKEN|b64enc#,
+// #NAME|lower|trunc 63# or ${REPLICAS|default 1|int}. See applyFilter.
+//
+// The value of a variable can itself hold placeholders, which are expanded
+// before it is used. See lookupExpanded.
+type Substituter struct {
+	lookup  Lookup
+	options SubstitutionOptions
+	// expanding is the chain of variables being expanded
+	expanding []string
+	// secret, when set, tells whether the value of a variable is a secret,
+	// which is never expanded
+	secret func(name string) bool
+	// observe, when set, is told about every placeholder found and how it
+	// resolved, r being nil when it did not
+	observe func(p *placeholder, r *resolved, err error)
+	// deferred makes expand replace the placeholders without resolving
+	// them, r being nil
+	deferred bool
+}
+
+type SubstitutionOptions struct {
+	// Strict reports every placeholder left unresolved as an error instead
+	// of keeping it in the output.
+	Strict bool
+	Mode   SubstitutionMode
+	AVP    AVPOptions
+	// Delimiters default to ${NAME} and #NAME#
+	Delimiters []Delimiters
+	// Paths restricts the substitution to some YAML paths, see parseYAMLPath
+	Paths []YAMLPath
+}
+
+// AVPOptions enables the argocd-vault-plugin placeholders, see
+// parseAVPPlaceholder.
+type AVPOptions struct {
+	Enabled bool
+	// Backend is the reference scheme the AVP paths are resolved with
+	Backend string
+	// Path is the avp.kubernetes.io/path annotation, used by <key>
+	Path string
+}
+
+// SubstitutionMode tells how a document is substituted.
+type SubstitutionMode string
+
+const (
+	// TextMode replaces the placeholders in the raw document
+	TextMode SubstitutionMode = "text"
+	// YAMLMode parses the document and only replaces placeholders inside
+	// scalars, which are then quoted according to their new content
+	YAMLMode SubstitutionMode = "yaml"
+)
+
+func parseSubstitutionMode(mode string) (SubstitutionMode, error) {
+	switch SubstitutionMode(mode) {
+	case "", TextMode:
+		return TextMode, nil
+	case YAMLMode:
+		return YAMLMode, nil
+	}
+	return "", fmt.Errorf("unknown substitution mode %q, expected %s or %s", mode, TextMode, YAMLMode)
+}
+
+func NewSubstituter(lookup Lookup, options SubstitutionOptions) *Substituter {
+	return &Substituter{lookup: lookup, options: options}
+}
+
+// Substitute returns values with every placeholder resolved. All the
+// failures found in the document are reported together, one error per
+// placeholder.
+func (substituter *Substituter) Substitute(values []byte) ([]byte, error) {
+	if substituter.options.Mode == YAMLMode || len(substituter.options.Paths) > 0 {
+		return substituter.substituteYAML(values)
+	}
+	return substituter.expand(values, func(p *placeholder, r *resolved) string {
+		return r.value
+	})
+}
+
+// Delimiters are the strings a placeholder starts and ends with.
+type Delimiters struct {
+	Open  string
+	Close string
+}
+
+// defaultDelimiters are the ${NAME} and #NAME# placeholders.
+var defaultDelimiters = []Delimiters{{Open: "${", Close: "}"}, {Open: "#", Close: "#"}}
+
+// parseDelimiters parses a comma separated list of delimiters written
+// OPEN..CLOSE, e.g. "@@..@@,{{env ..}}".
+func parseDelimiters(value string) ([]Delimiters, error) {
+	var delimiters []Delimiters
+	for _, pair := range strings.Split(value, ",") {
+		open, close, ok := strings.Cut(strings.TrimSpace(pair), "..")
+		open = strings.TrimSpace(open)
+		close = strings.TrimSpace(close)
+		if !ok || open == "" || close == "" {
+			return nil, fmt.Errorf("invalid delimiters %q, expected OPEN..CLOSE", pair)
+		}
+		delimiters = append(delimiters, Delimiters{Open: open, Close: close})
+	}
+	return delimiters, nil
+}
+
+// isDigits tells whether bs is made of decimal digits only.
+func isDigits(bs []byte) bool {
+	for _, b := range bs {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return len(bs) > 0
+}
+
+// parsePlaceholder parses the expression found between the delimiters. The
+// ${NAME} form supports the shell operators, and the custom delimiters too.
+// Spaces around the name and the filters are only allowed with custom
+// delimiters, as in {{env NAME | upper}}.
+func (d Delimiters) parsePlaceholder(raw string, expr string) *placeholder {
+	switch d {
+	case Delimiters{Open: "#", Close: "#"}:
+		return parsePlaceholder(raw, expr, false)
+	case Delimiters{Open: "${", Close: "}"}:
+		return parsePlaceholder(raw, expr, true)
+	}
+	pipeline := splitPipeline(expr)
+	for i := range pipeline {
+		pipeline[i] = strings.TrimSpace(pipeline[i])
+	}
+	return parsePlaceholder(raw, strings.Join(pipeline, "|"), true)
+}
+
+// String writes the delimiters as parsed by parseDelimiters.
+func (d Delimiters) String() string {
+	return d.Open + ".." + d.Close
+}
+
+// placeholder is a placeholder found in a document.
+type placeholder struct {
+	// raw is the placeholder as written, delimiters included
+	raw  string
+	line int
+	// quote is the quote character surrounding the placeholder, if any
+	quote byte
+
+	name string
+	// operator is ":-" or ":?" in the shell form, argument being the default
+	// value or the error message
+	operator string
+	argument string
+	// filters is the pipeline following the name, e.g. "lower" and
+	// "trunc 63" in #NAME|lower|trunc 63#
+	filters []string
+}
+
+// resolved is the value of a placeholder.
+type resolved struct {
+	value string
+	// tag is the YAML tag asked by a type hint, empty when the type of the
+	// value is left to its content
+	tag string
+	// set is false as long as the variable is not set and no default applied
+	set bool
+}
+
+// expand walks values and writes, in place of every placeholder it
+// resolves, what replace returns for it.
+func (substituter *Substituter) expand(values []byte, replace func(p *placeholder, r *resolved) string) ([]byte, error) {
+	var out bytes.Buffer
+	var errs []error
+
+	delimiters := substituter.options.Delimiters
+	if len(delimiters) <= 0 {
+		delimiters = defaultDelimiters
+	}
+	// $$ only escapes the ${NAME} placeholders of the document, the values
+	// of the variables are kept as is
+	escape := false
+	for _, d := range delimiters {
+		escape = escape || (d.Open == "${" && len(substituter.expanding) <= 0)
+	}
+
+	for i := 0; i < len(values); {
+		var p *placeholder
+		// reopen is the length of a closing delimiter that can open the
+		// next placeholder, e.g. in "#UNSET#NAME#"
+		reopen := 0
+		switch {
+		case escape && bytes.HasPrefix(values[i:], []byte("$$")):
+			out.WriteByte('$')
+			i += 2
+			continue
+
+		case values[i] == '<' && substituter.options.AVP.Enabled:
+			if end := bytes.IndexByte(values[i+1:], '>'); end >= 0 {
+				p = substituter.options.AVP.parsePlaceholder(string(values[i:i+2+end]), string(values[i+1:i+1+end]))
+			}
+		}
+
+		for _, d := range delimiters {
+			if p != nil || !bytes.HasPrefix(values[i:], []byte(d.Open)) {
+				continue
+			}
+			start := i + len(d.Open)
+			end := bytes.Index(values[start:], []byte(d.Close))
+			if end < 0 {
+				continue
+			}
+			if d.Close == "#" && bytes.HasPrefix(values[start:], []byte(vaultReferenceScheme+":")) {
+				// #vault:path#key# holds a '#' between the path and the key,
+				// and #vault:path#key#version# another one before a version
+				if key := bytes.IndexByte(values[start+end+1:], '#'); key >= 0 {
+					end += key + 1
+					if version := bytes.IndexByte(values[start+end+1:], '#'); version > 0 && isDigits(values[start+end+1:start+end+1+version]) {
+						end += version + 1
+					}
+				}
+			}
+			p = d.parsePlaceholder(string(values[i:start+end+len(d.Close)]), string(values[start:start+end]))
+			if d.Open == d.Close {
+				reopen = len(d.Close)
+			}
+		}
+
+		if p == nil {
+			out.WriteByte(values[i])
+			i++
+			continue
+		}
+
+		p.line = lineOf(values, i)
+		next := i + len(p.raw)
+		if i > 0 && next < len(values) && values[i-1] == values[next] && (values[next] == '"' || values[next] == '\'') {
+			p.quote = values[next]
+		}
+		if substituter.deferred {
+			out.WriteString(replace(p, nil))
+			i = next
+			continue
+		}
+
+		r, err := substituter.resolve(p)
+		if substituter.observe != nil {
+			substituter.observe(p, r, err)
+		}
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("line %d: %w", p.line, err))
+			out.WriteString(p.raw)
+		case r == nil:
+			errs = append(errs, substituter.unresolved(p))
+			// Keep the unresolved name but not its closing delimiter when it
+			// may open the next placeholder
+			next -= reopen
+			out.WriteString(p.raw[:next-i])
+		case p.quote != 0 && isTypedTag(r.tag) && substituter.options.Mode != YAMLMode:
+			// A type hint on a quoted placeholder drops the quotes, otherwise
+			// the value would still read as a string
+			out.Truncate(out.Len() - 1)
+			out.WriteString(replace(p, r))
+			next++
+		default:
+			out.WriteString(replace(p, r))
+		}
+		i = next
+	}
+
+	return out.Bytes(), errors.Join(errs...)
+}
+
+// parsePlaceholder parses the expression found between the delimiters of a
+// placeholder. It returns nil when the expression isn't a placeholder, e.g.
+// for "# a comment #".
+func parsePlaceholder(raw string, expr string, shell bool) *placeholder {
+	pipeline := splitPipeline(expr)
+	p := &placeholder{raw: raw, name: pipeline[0], filters: pipeline[1:]}
+
+	if shell {
+		if idx := shellOperator(p.name); idx >= 0 {
+			p.name, p.operator, p.argument = p.name[:idx], p.name[idx:idx+2], p.name[idx+2:]
+		}
+	}
+	if !placeholderName.MatchString(p.name) && !isReference(p.name) {
+		return nil
+	}
+	for i, filter := range p.filters {
+		p.filters[i] = strings.TrimSpace(filter)
+		if p.filters[i] == "" {
+			return nil
+		}
+	}
+	return p
+}
+
+// shellOperator returns the index of the first ":-" or ":?" operator, or -1.
+func shellOperator(expr string) int {
+	for i := 0; i+1 < len(expr); i++ {
+		if expr[i] == ':' && (expr[i+1] == '-' || expr[i+1] == '?') {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitPipeline splits an expression on the '|' that are not quoted.
+func splitPipeline(expr string) []string {
+	var parts []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && quoted:
+			i++
+		case expr[i] == '"':
+			quoted = !quoted
+		case expr[i] == '|' && !quoted:
+			parts = append(parts, expr[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+// resolve returns the value of a placeholder, or nil when it must be kept
+// as is.
+func (substituter *Substituter) resolve(p *placeholder) (*resolved, error) {
+	value, ok, err := substituter.lookupExpanded(p.name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.raw, err)
+	}
+	switch p.operator {
+	case ":-":
+		if !ok || value == "" {
+			value, ok = p.argument, true
+		}
+	case ":?":
+		if !ok || value == "" {
+			if p.argument == "" {
+				return nil, fmt.Errorf("%s: parameter null or not set", p.name)
+			}
+			return nil, fmt.Errorf("%s: %s", p.name, p.argument)
+		}
+	}
+	r := &resolved{value: value, set: ok}
+	for _, filter := range p.filters {
+		if err := applyFilter(filter, r); err != nil {
+			return nil, fmt.Errorf("%s: %w", p.raw, err)
+		}
+	}
+	if !r.set {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// lookupExpanded looks a variable up and expands the placeholders of its
+// value, recursively. The values of references, and the other secrets, are
+// taken as is. The errors never quote a value.
+func (substituter *Substituter) lookupExpanded(name string) (string, bool, error) {
+	value, ok, err := substituter.lookup(name)
+	if err != nil || !ok || isReference(name) || (substituter.secret != nil && substituter.secret(name)) {
+		return value, ok, err
+	}
+
+	for i, expanding := range substituter.expanding {
+		if expanding == name {
+			chain := append(substituter.expanding[i:len(substituter.expanding):len(substituter.expanding)], name)
+			return "", false, &expansionError{fmt.Sprintf("cycle in variables %s", strings.Join(chain, " -> "))}
+		}
+	}
+	if len(substituter.expanding) >= maxExpansionDepth {
+		return "", false, &expansionError{fmt.Sprintf("variables nested deeper than %d: %s", maxExpansionDepth, strings.Join(append(substituter.expanding, name), " -> "))}
+	}
+
+	// The placeholders of the value are not part of the document, they are
+	// not reported to observe
+	observe := substituter.observe
+	substituter.observe = nil
+	substituter.expanding = append(substituter.expanding, name)
+	defer func() {
+		substituter.observe = observe
+		substituter.expanding = substituter.expanding[:len(substituter.expanding)-1]
+	}()
+
+	expanded, err := substituter.expand([]byte(value), func(p *placeholder, r *resolved) string {
+		return r.value
+	})
+	if err != nil {
+		// A cycle is reported once, with the whole chain
+		var expansionErr *expansionError
+		if errors.As(err, &expansionErr) {
+			return "", false, expansionErr
+		}
+		return "", false, fmt.Errorf("a placeholder of the value of %s can't be resolved", name)
+	}
+	return string(expanded), true, nil
+}
+
+// expansionError reports a cycle or a too deep nesting of variables.
+type expansionError struct {
+	msg string
+}
+
+func (err *expansionError) Error() string {
+	return err.msg
+}
+
+// unresolved returns the error reported in strict mode for a placeholder
+// that could not be resolved, or nil otherwise.
+func (substituter *Substituter) unresolved(p *placeholder) error {
+	// The placeholders of the values of the variables are kept as is
+	if !substituter.options.Strict || len(substituter.expanding) > 0 {
+		return nil
+	}
+	return fmt.Errorf("line %d: %s is not set", p.line, p.raw)
+}
+
+// prefixErrors prefixes every error joined in err, so that each of them
+// still reads on its own line.
+func prefixErrors(prefix string, err error) error {
+	if err == nil {
+		return nil
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return fmt.Errorf("%s: %w", prefix, err)
+	}
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, prefixErrors(prefix, e))
+	}
+	return errors.Join(errs...)
+}
+
+// lineOf returns the 1-based line number of the given offset.
+func lineOf(values []byte, offset int) int {
+	return bytes.Count(values[:offset], []byte("\n")) + 1
+}
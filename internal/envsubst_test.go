@@ -0,0 +1,360 @@
+package internal_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	app "github.com/qjoly/argocd-plugin-helm-envsubst/internal"
+)
+
+func lookupFrom(envs map[string]string) app.Lookup {
+	return func(name string) (string, bool, error) {
+		value, ok := envs[name]
+		return value, ok, nil
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	envs := map[string]string{
+		"HOST":  "db.local",
+		"PORT":  "5432",
+		"EMPTY": "",
+	}
+
+	tests := []struct {
+		name   string
+		values string
+		want   string
+	}{
+		{"hash", "host: #HOST#", "host: db.local"},
+		{"hash unset", "host: #UNSET#", "host: #UNSET#"},
+		{"hash chained", "#UNSET#PORT#", "#UNSET5432"},
+		{"hash comment", "# not #a placeholder", "# not #a placeholder"},
+		{"shell", "url: ${HOST}:${PORT}", "url: db.local:5432"},
+		{"shell unset", "host: ${UNSET}", "host: ${UNSET}"},
+		{"shell default", "host: ${UNSET:-localhost}", "host: localhost"},
+		{"shell default empty", "host: ${EMPTY:-localhost}", "host: localhost"},
+		{"shell default set", "host: ${HOST:-localhost}", "host: db.local"},
+		{"shell required set", "host: ${HOST:?host is required}", "host: db.local"},
+		{"escape", "cmd: echo $${HOST} $$1", "cmd: echo ${HOST} $1"},
+		{"unterminated", "cmd: ${HOST", "cmd: ${HOST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := app.NewSubstituter(lookupFrom(envs), app.SubstitutionOptions{}).Substitute([]byte(tt.values))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubstituteRequired(t *testing.T) {
+	values := "a: ${A:?A is required}\nb: ${B:?}\n"
+
+	_, err := app.NewSubstituter(lookupFrom(nil), app.SubstitutionOptions{}).Substitute([]byte(values))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"line 1: A: A is required", "line 2: B: parameter null or not set"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestSubstituteStrict(t *testing.T) {
+	values := "host: #DB_HOST#\nport: ${DB_PORT}\nuser: ${DB_USER:-app}\n"
+
+	_, err := app.NewSubstituter(lookupFrom(nil), app.SubstitutionOptions{Strict: true}).Substitute([]byte(values))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"line 1: #DB_HOST# is not set", "line 2: ${DB_PORT} is not set"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "DB_USER") {
+		t.Errorf("error %q reports a placeholder with a default", err)
+	}
+}
+
+func TestSubstituteYAML(t *testing.T) {
+	envs := map[string]string{
+		"CERT":     "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----",
+		"JSON":     `{"key": "value", "list": [1, 2]}`,
+		"COMMENT":  "value # not a comment",
+		"QUOTE":    `it's "quoted"`,
+		"REPLICAS": "3",
+		"HOST":     "db.local",
+	}
+
+	values := `# keep #HOST# in comments
+tls:
+  cert: #CERT#
+  quoted: "#CERT#"
+config: ${JSON}
+note: #COMMENT#
+quote: ${QUOTE}
+replicaCount: #REPLICAS#
+url: postgres://#HOST#:5432 # connect to #HOST#
+`
+	want := `# keep #HOST# in comments
+tls:
+  cert: |-
+    -----BEGIN CERTIFICATE-----
+    MIIB
+    -----END CERTIFICATE-----
+  quoted: "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----"
+config: '{"key": "value", "list": [1, 2]}'
+note: 'value # not a comment'
+quote: it's "quoted"
+replicaCount: 3
+url: postgres://db.local:5432 # connect to #HOST#
+`
+
+	got, err := app.NewSubstituter(lookupFrom(envs), app.SubstitutionOptions{Mode: app.YAMLMode}).Substitute([]byte(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSubstituteYAMLStrictComments(t *testing.T) {
+	envs := map[string]string{"HOST": "db.local"}
+	values := "# TODO #UNSET# later\nhost: #HOST# # not #ALSO_UNSET#\n"
+	want := "# TODO #UNSET# later\nhost: db.local # not #ALSO_UNSET#\n"
+
+	got, err := app.NewSubstituter(lookupFrom(envs), app.SubstitutionOptions{Mode: app.YAMLMode, Strict: true}).Substitute([]byte(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSubstituteYAMLUnresolved(t *testing.T) {
+	// Nothing is substituted, the document is kept as it was written
+	values := "a: #FOO#\nlist: [ ${BAR} ]   # see #BAZ#\n"
+	got, err := app.NewSubstituter(lookupFrom(nil), app.SubstitutionOptions{Mode: app.YAMLMode}).Substitute([]byte(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != values {
+		t.Errorf("got:\n%s\nwant:\n%s", got, values)
+	}
+}
+
+func TestSubstituteTypeHints(t *testing.T) {
+	envs := map[string]string{
+		"REPLICAS": "3",
+		"PORT":     "8080",
+		"DEBUG":    "1",
+		"RATIO":    "2",
+		"VERSION":  "1.10",
+		"MODE":     "0755",
+	}
+
+	tests := []struct {
+		name   string
+		mode   app.SubstitutionMode
+		values string
+		want   string
+	}{
+		{"text int", app.TextMode, "replicas: #REPLICAS|int#", "replicas: 3"},
+		{"text quoted int", app.TextMode, `port: "#PORT|int#"`, "port: 8080"},
+		{"text quoted untyped", app.TextMode, `port: "#PORT#"`, `port: "8080"`},
+		{"text bool", app.TextMode, "debug: '${DEBUG|bool}'", "debug: true"},
+		{"text float", app.TextMode, "ratio: #RATIO|float#", "ratio: 2.0"},
+		{"text string", app.TextMode, `version: "#VERSION|string#"`, `version: "1.10"`},
+		{"yaml inferred", app.YAMLMode, "replicas: #REPLICAS#\n", "replicas: 3\n"},
+		{"yaml quoted kept", app.YAMLMode, "port: \"#PORT#\"\n", "port: \"8080\"\n"},
+		{"yaml bool", app.YAMLMode, "debug: \"#DEBUG|bool#\"\n", "debug: true\n"},
+		{"yaml quoted float kept", app.YAMLMode, "version: \"#VERSION#\"\n", "version: \"1.10\"\n"},
+		{"yaml float", app.YAMLMode, "ratio: \"#RATIO|float#\"\n", "ratio: 2.0\n"},
+		{"yaml plain inferred", app.YAMLMode, "port: #PORT#\n", "port: 8080\n"},
+		{"yaml string", app.YAMLMode, "version: \"#VERSION|string#\"\n", "version: \"1.10\"\n"},
+		{"yaml plain string", app.YAMLMode, "replicas: #REPLICAS|string#\n", "replicas: \"3\"\n"},
+		{"yaml octal kept", app.YAMLMode, "mode: #MODE#\n", "mode: \"0755\"\n"},
+		{"yaml partial", app.YAMLMode, "url: \"http://host:#PORT|int#\"\n", "url: \"http://host:8080\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := app.NewSubstituter(lookupFrom(envs), app.SubstitutionOptions{Mode: tt.mode}).Substitute([]byte(tt.values))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubstituteTypeHintErrors(t *testing.T) {
+	envs := map[string]string{"PORT": "http"}
+
+	_, err := app.NewSubstituter(lookupFrom(envs), app.SubstitutionOptions{}).Substitute([]byte("port: #PORT|int#\nother: #PORT|number#\n"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{`line 1: #PORT|int#: "http" is not an int`, `line 2: #PORT|number#: unknown filter "number"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestSubstituteFilters(t *testing.T) {
+	envs := map[string]string{
+		"TOKEN": "s3cr3t",
+		"NAME":  "My-Very-Long-Application-Name",
+		"CERT":  "line1\nline2",
+		"EMPTY": "",
+		"SPACE": "  padded  ",
+	}
+
+	tests := []struct {
+		values string
+		want   string
+	}{
+		{"#TOKEN|b64enc#", "czNjcjN0"},
+		{"#TOKEN|b64enc|b64dec#", "s3cr3t"},
+		{"#NAME|lower|trunc 10#", "my-very-lo"},
+		{"${NAME|upper}", "MY-VERY-LONG-APPLICATION-NAME"},
+		{"#TOKEN|quote#", `"s3cr3t"`},
+		{"#TOKEN|squote#", `'s3cr3t'`},
+		{"#SPACE|trim#", "padded"},
+		{`#UNSET|default "foo|bar"#`, "foo|bar"},
+		{"#EMPTY|default foo#", "foo"},
+		{"#TOKEN|default foo#", "s3cr3t"},
+		{"#UNSET|lower#", "#UNSET|lower#"},
+		{"#TOKEN|required#", "s3cr3t"},
+		{"cert:\n#CERT|indent 2#", "cert:\n  line1\n  line2"},
+		{"cert:#CERT|nindent 2#", "cert:\n  line1\n  line2"},
+		{"replicas: #UNSET|default 2|int#", "replicas: 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.values, func(t *testing.T) {
+			got, err := app.NewSubstituter(lookupFrom(envs), app.SubstitutionOptions{}).Substitute([]byte(tt.values))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubstituteFilterErrors(t *testing.T) {
+	values := "a: #UNSET|required#\nb: #UNSET|required \"set B\"#\nc: #TOKEN|base64#\nd: #TOKEN|trunc x#\n"
+
+	_, err := app.NewSubstituter(lookupFrom(map[string]string{"TOKEN": "t"}), app.SubstitutionOptions{}).Substitute([]byte(values))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"line 1: #UNSET|required#: value is required",
+		`line 2: #UNSET|required "set B"#: set B`,
+		`line 3: #TOKEN|base64#: unknown filter "base64"`,
+		`line 4: #TOKEN|trunc x#: trunc expects a positive number, got "x"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestSubstituteRecursive(t *testing.T) {
+	envs := map[string]string{
+		"DB_HOST": "db.local",
+		"DB_PORT": "5432",
+		"DB_URL":  "postgres://#DB_HOST#:${DB_PORT}/app",
+		"DSN":     "${DB_URL}?sslmode=require",
+		"PRICE":   "$$5",
+		"SECRET":  "#file:/run/secret#",
+		"A":       "#B#",
+		"B":       "${C}",
+		"C":       "#A#",
+	}
+	lookup := func(name string) (string, bool, error) {
+		if name == "file:/run/secret" {
+			return "#DB_HOST#", true, nil
+		}
+		value, ok := envs[name]
+		return value, ok, nil
+	}
+	substituter := app.NewSubstituter(lookup, app.SubstitutionOptions{})
+
+	got, err := substituter.Substitute([]byte("url: #DSN#\nprice: #PRICE#\nsecret: #SECRET#\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "url: postgres://db.local:5432/app?sslmode=require\nprice: $$5\nsecret: #DB_HOST#\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = substituter.Substitute([]byte("a: ok\nb: #B#\n"))
+	if want := "line 2: #B#: cycle in variables B -> C -> A -> B"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestSubstituteRecursiveDepth(t *testing.T) {
+	envs := map[string]string{}
+	for i := 0; i < 12; i++ {
+		envs[fmt.Sprintf("V%d", i)] = fmt.Sprintf("#V%d#", i+1)
+	}
+	envs["V12"] = "end"
+
+	_, err := app.NewSubstituter(lookupFrom(envs), app.SubstitutionOptions{}).Substitute([]byte("#V0#"))
+	if err == nil || !strings.Contains(err.Error(), "nested deeper than 10: V0 -> V1") {
+		t.Errorf("expected a depth error, got %v", err)
+	}
+}
+
+func TestSubstituteDelimiters(t *testing.T) {
+	envs := map[string]string{"NAME": "app", "UNSET_TOO": "x"}
+	tests := []struct {
+		delimiters []app.Delimiters
+		values     string
+		want       string
+	}{
+		{
+			delimiters: []app.Delimiters{{Open: "@@", Close: "@@"}},
+			values:     "name: @@NAME@@\nscript: echo #NAME# ${NAME} $$HOME\nmissing: @@UNSET@@NAME@@\n",
+			want:       "name: app\nscript: echo #NAME# ${NAME} $$HOME\nmissing: @@UNSETapp\n",
+		},
+		{
+			delimiters: []app.Delimiters{{Open: "{{env", Close: "}}"}},
+			values:     "name: {{env NAME}}\nupper: {{env NAME | upper}}\ndefault: {{env REGION:-eu}}\ntemplate: {{ .Values.name }}\n",
+			want:       "name: app\nupper: APP\ndefault: eu\ntemplate: {{ .Values.name }}\n",
+		},
+		{
+			delimiters: []app.Delimiters{{Open: "${", Close: "}"}},
+			values:     "name: ${NAME}\ncomment: #NAME#\nescaped: $${NAME}\n",
+			want:       "name: app\ncomment: #NAME#\nescaped: ${NAME}\n",
+		},
+	}
+	for _, tt := range tests {
+		got, err := app.NewSubstituter(lookupFrom(envs), app.SubstitutionOptions{Delimiters: tt.delimiters}).Substitute([]byte(tt.values))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.delimiters, got, tt.want)
+		}
+	}
+}
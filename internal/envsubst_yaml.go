@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// substituteYAML resolves the placeholders of a YAML stream without letting
+// their values change its structure. Placeholders are first swapped for
+// plain tokens, so that the stream can be parsed even when a "#NAME#" would
+// otherwise read as a comment. The values are then put back inside scalar
+// nodes only, and the encoder quotes them according to their content.
+//
+// The placeholders are only resolved once found in a scalar, and inside one
+// of the paths when the substitution is restricted to some, so that those
+// of the comments are kept as is.
+func (substituter *Substituter) substituteYAML(values []byte) ([]byte, error) {
+	// The tokens must not collide with the content of the document
+	nonce := 0
+	for bytes.Contains(values, []byte(fmt.Sprintf("__envsubst_%d_", nonce))) {
+		nonce++
+	}
+
+	substituter.deferred = true
+	defer func() {
+		substituter.deferred = false
+	}()
+
+	var placeholders []*placeholder
+	tokenized, err := substituter.expand(values, func(p *placeholder, r *resolved) string {
+		placeholders = append(placeholders, p)
+		return yamlToken(nonce, len(placeholders)-1)
+	})
+	substituter.deferred = false
+	if err != nil {
+		return nil, err
+	}
+	if len(placeholders) <= 0 {
+		return tokenized, nil
+	}
+
+	tokens := regexp.MustCompile(fmt.Sprintf(`__envsubst_%d_(\d+)__`, nonce))
+	index := func(token string) int {
+		i, _ := strconv.Atoi(tokens.FindStringSubmatch(token)[1])
+		return i
+	}
+	raw := func(str string) string {
+		return tokens.ReplaceAllStringFunc(str, func(token string) string {
+			return placeholders[index(token)].raw
+		})
+	}
+
+	// value returns the value of a placeholder found at path, or nil when it
+	// is kept as is
+	var errs []error
+	substituted := false
+	value := func(i int, path []string) *resolved {
+		if len(substituter.options.Paths) > 0 && !substituter.inScope(path) {
+			return nil
+		}
+		// A placeholder is resolved once, a token standing for a single
+		// placeholder
+		p := placeholders[i]
+		r, err := substituter.resolve(p)
+		if substituter.observe != nil {
+			substituter.observe(p, r, err)
+		}
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("line %d: %w", p.line, err))
+		case r == nil:
+			errs = append(errs, substituter.unresolved(p))
+		default:
+			substituted = true
+		}
+		return r
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(tokenized))
+	for {
+		var document yaml.Node
+		if err := decoder.Decode(&document); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("parse YAML: %w", err)
+		}
+
+		walkYAML(&document, nil, func(node *yaml.Node, path []string) {
+			// Placeholders found in comments are not substituted, as comments
+			// are not meant to hold values
+			node.HeadComment = raw(node.HeadComment)
+			node.LineComment = raw(node.LineComment)
+			node.FootComment = raw(node.FootComment)
+
+			if node.Kind != yaml.ScalarNode || !tokens.MatchString(node.Value) {
+				return
+			}
+
+			if tokens.FindString(node.Value) == node.Value {
+				// The scalar is a single placeholder, it is typed after the
+				// type hint, otherwise a quoted scalar stays a string and a
+				// plain one is typed after the content of the value
+				r := value(index(node.Value), path)
+				if r == nil {
+					node.Value = raw(node.Value)
+					return
+				}
+				quoted := node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0
+				node.Value, node.Tag = r.value, r.tag
+				switch {
+				case node.Tag == "" && quoted:
+					node.Tag = strTag
+				case node.Tag == "":
+					node.Tag = inferTag(r.value)
+				}
+				if node.Tag != strTag {
+					node.Style = 0
+				}
+				return
+			}
+
+			node.Value = tokens.ReplaceAllStringFunc(node.Value, func(token string) string {
+				if r := value(index(token), path); r != nil {
+					return r.value
+				}
+				return placeholders[index(token)].raw
+			})
+			if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				// A plain scalar gets the type of its new content, as it
+				// would with a raw substitution
+				node.Tag = ""
+			}
+		})
+
+		if err := encoder.Encode(&document); err != nil {
+			return nil, fmt.Errorf("encode YAML: %w", err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("encode YAML: %w", err)
+	}
+
+	// The encoder reformats the document, and quotes the placeholders kept
+	// as is, so a document without any value is returned as it was written
+	if !substituted {
+		return []byte(raw(string(tokenized))), errors.Join(errs...)
+	}
+	return out.Bytes(), errors.Join(errs...)
+}
+
+// yamlToken returns the plain scalar standing for the index-th placeholder.
+func yamlToken(nonce int, index int) string {
+	return fmt.Sprintf("__envsubst_%d_%d__", nonce, index)
+}
+
+// walkYAML visits every node with its path, made of the mapping keys and
+// the "[index]" of the sequence items leading to it. A mapping key has the
+// path of its value.
+func walkYAML(node *yaml.Node, path []string, visit func(node *yaml.Node, path []string)) {
+	visit(node, path)
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			child := append(path[:len(path):len(path)], node.Content[i].Value)
+			walkYAML(node.Content[i], child, visit)
+			walkYAML(node.Content[i+1], child, visit)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			walkYAML(item, append(path[:len(path):len(path)], fmt.Sprintf("[%d]", i)), visit)
+		}
+	default:
+		for _, child := range node.Content {
+			walkYAML(child, path, visit)
+		}
+	}
+}
+
+// YAMLPath selects nodes of a YAML document, e.g. .cloudflare.* or
+// .ingress.hosts[*]. Each element is a mapping key, "*" for any key, "[N]"
+// for the N-th item of a sequence or "[*]" for any item.
+type YAMLPath []string
+
+// parseYAMLPath parses a path written as .key.*.list[*], "." selecting
+// the whole document.
+func parseYAMLPath(path string) (YAMLPath, error) {
+	if !strings.HasPrefix(path, ".") {
+		return nil, fmt.Errorf("invalid path %q, expected a path starting with a dot", path)
+	}
+	parsed := YAMLPath{}
+	if path == "." {
+		return parsed, nil
+	}
+	for i, part := range strings.Split(path[1:], ".") {
+		key, rest := part, ""
+		if j := strings.IndexByte(part, '['); j >= 0 {
+			key, rest = part[:j], part[j:]
+		}
+		// Only a document being a sequence starts with an index, e.g. .[0]
+		if key == "" && (i > 0 || rest == "") {
+			return nil, fmt.Errorf("invalid path %q, empty key", path)
+		}
+		if key != "" {
+			parsed = append(parsed, key)
+		}
+		for len(rest) > 0 {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid path %q", path)
+			}
+			index := rest[1:end]
+			if _, err := strconv.Atoi(index); err != nil && index != "*" {
+				return nil, fmt.Errorf("invalid index %q in path %q", index, path)
+			}
+			parsed = append(parsed, "["+index+"]")
+			rest = rest[end+1:]
+		}
+	}
+	return parsed, nil
+}
+
+// parseYAMLPaths parses a comma separated list of paths.
+func parseYAMLPaths(value string) ([]YAMLPath, error) {
+	var paths []YAMLPath
+	for _, path := range strings.Split(value, ",") {
+		parsed, err := parseYAMLPath(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, parsed)
+	}
+	return paths, nil
+}
+
+// matches tells whether a node at path is selected by the YAML path, or is
+// below a selected node.
+func (yamlPath YAMLPath) matches(path []string) bool {
+	if len(path) < len(yamlPath) {
+		return false
+	}
+	for i, element := range yamlPath {
+		isIndex := strings.HasPrefix(path[i], "[")
+		switch {
+		case element == "*" && !isIndex, element == "[*]" && isIndex:
+		case element != path[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// inScope tells whether the placeholders at path are substituted.
+func (substituter *Substituter) inScope(path []string) bool {
+	for _, yamlPath := range substituter.options.Paths {
+		if yamlPath.matches(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	strTag   = "!!str"
+	intTag   = "!!int"
+	floatTag = "!!float"
+	boolTag  = "!!bool"
+)
+
+var (
+	// intValue and floatValue only match the numbers written in decimal,
+	// so that a value like "0755" or "1e3" keeps being a string
+	intValue   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	floatValue = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)\.[0-9]+$`)
+	boolValue  = regexp.MustCompile(`^(true|True|TRUE|false|False|FALSE)$`)
+)
+
+// applyFilter applies a filter of the placeholder pipeline to its value:
+//
+//	default VALUE    VALUE when the variable is unset or empty
+//	required [MSG]   fail when the variable is unset or empty
+//	b64enc, b64dec   base64 encode or decode
+//	quote, squote    wrap in double or single quotes
+//	lower, upper     change the case
+//	trim             remove the leading and trailing spaces
+//	trunc N          keep the first N characters
+//	indent N         indent every line with N spaces
+//	nindent N        same as indent, starting with a new line
+//	int, float, bool check the value and type it in the output
+//	string           type the value as a string in the output
+//
+// Filters other than default and required are skipped while the variable
+// is unset.
+func applyFilter(filter string, r *resolved) error {
+	name, args, err := parseFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	switch name {
+	case "default":
+		if len(args) != 1 {
+			return fmt.Errorf("default expects a value")
+		}
+		if !r.set || r.value == "" {
+			r.value, r.set = args[0], true
+		}
+		return nil
+	case "required":
+		if len(args) > 1 {
+			return fmt.Errorf("required expects at most a message")
+		}
+		if !r.set || r.value == "" {
+			if len(args) == 1 {
+				return fmt.Errorf("%s", args[0])
+			}
+			return fmt.Errorf("value is required")
+		}
+		return nil
+	}
+
+	if !isFilter(name) {
+		return fmt.Errorf("unknown filter %q", name)
+	}
+	if !r.set {
+		return nil
+	}
+
+	switch name {
+	case "b64enc":
+		r.value = base64.StdEncoding.EncodeToString([]byte(r.value))
+	case "b64dec":
+		decoded, err := base64.StdEncoding.DecodeString(r.value)
+		if err != nil {
+			return fmt.Errorf("b64dec: %w", err)
+		}
+		r.value = string(decoded)
+	case "quote":
+		r.value = strconv.Quote(r.value)
+	case "squote":
+		r.value = "'" + strings.ReplaceAll(r.value, "'", "''") + "'"
+	case "lower":
+		r.value = strings.ToLower(r.value)
+	case "upper":
+		r.value = strings.ToUpper(r.value)
+	case "trim":
+		r.value = strings.TrimSpace(r.value)
+	case "trunc", "indent", "nindent":
+		if len(args) != 1 {
+			return fmt.Errorf("%s expects a number", name)
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s expects a positive number, got %q", name, args[0])
+		}
+		switch name {
+		case "trunc":
+			if runes := []rune(r.value); len(runes) > n {
+				r.value = string(runes[:n])
+			}
+		case "indent":
+			r.value = indent(r.value, n)
+		case "nindent":
+			r.value = "\n" + indent(r.value, n)
+		}
+	case "int":
+		i, err := strconv.ParseInt(strings.TrimSpace(r.value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an int", r.value)
+		}
+		r.value, r.tag = strconv.FormatInt(i, 10), intTag
+	case "float":
+		f, err := strconv.ParseFloat(strings.TrimSpace(r.value), 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a float", r.value)
+		}
+		r.value = strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.Contains(r.value, ".") {
+			r.value += ".0"
+		}
+		r.tag = floatTag
+	case "bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(r.value))
+		if err != nil {
+			return fmt.Errorf("%q is not a bool", r.value)
+		}
+		r.value, r.tag = strconv.FormatBool(b), boolTag
+	case "string":
+		r.tag = strTag
+	}
+	return nil
+}
+
+func isFilter(name string) bool {
+	switch name {
+	case "b64enc", "b64dec", "quote", "squote", "lower", "upper", "trim",
+		"trunc", "indent", "nindent", "int", "float", "bool", "string":
+		return true
+	}
+	return false
+}
+
+// parseFilter splits a filter into its name and arguments. Arguments are
+// separated by spaces, and can be double quoted to hold spaces or '|'.
+func parseFilter(filter string) (string, []string, error) {
+	var fields []string
+	for rest := strings.TrimSpace(filter); rest != ""; rest = strings.TrimLeftFunc(rest, unicode.IsSpace) {
+		if rest[0] != '"' {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			fields = append(fields, rest[:end])
+			rest = rest[end:]
+			continue
+		}
+
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid quoted argument in filter %q", filter)
+		}
+		unquoted, _ := strconv.Unquote(quoted)
+		fields = append(fields, unquoted)
+		rest = rest[len(quoted):]
+	}
+	return fields[0], fields[1:], nil
+}
+
+// indent prefixes every non-empty line of value with n spaces.
+func indent(value string, n int) string {
+	lines := strings.Split(value, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = strings.Repeat(" ", n) + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isTypedTag tells whether a tag asks for a non string scalar.
+func isTypedTag(tag string) bool {
+	return tag == intTag || tag == floatTag || tag == boolTag
+}
+
+// inferTag returns the type of a value substituted for a whole scalar.
+func inferTag(value string) string {
+	switch {
+	case intValue.MatchString(value):
+		return intTag
+	case floatValue.MatchString(value):
+		return floatTag
+	case boolValue.MatchString(value):
+		return boolTag
+	}
+	return strTag
+}
@@ -2,17 +2,26 @@ package internal
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+
+	"gopkg.in/yaml.v2"
 )
 
-type Generator struct{}
+type Generator struct {
+	// Strict fails the generation when a placeholder can't be resolved
+	Strict bool
+	Config *PluginConfig
+}
 
 func NewGenerator() *Generator {
-	return &Generator{}
+	return &Generator{Config: DefaultPluginConfig()}
 }
 
 func (generator *Generator) Generate() {
@@ -30,21 +39,148 @@ func (generator *Generator) Generate() {
 		fmt.Println("Error reading stdin:", err)
 		return
 	}
-	fmt.Println(string(applyEnvOnValues(content)))
+
+	// The providers are shared by all the documents, so that their caches
+	// last for the whole generation
+	chain, err := newProviderChain(generator.Config)
+	if err != nil {
+		log.Fatalf("Error creating value providers: %v", err)
+	}
+	// The manifests are generated from the current directory
+	if err := chain.loadDotenv("."); err != nil {
+		log.Fatalf("Error reading dotenv files: %v", err)
+	}
+	if err := chain.loadSchema("."); err != nil {
+		log.Fatalf("Error reading variable schema: %v", err)
+	}
+	if err := chain.validateSchema(); err != nil {
+		log.Fatalf("Invalid variables:\n%v", err)
+	}
+
+	// Each document is substituted on its own, so that the annotations of an
+	// Application only apply to its own manifest
+	var result bytes.Buffer
+	var errs []error
+	for i, document := range splitDocuments(content) {
+		application := Application{}
+		if err := yaml.Unmarshal(document, &application); err != nil {
+			application = Application{}
+		}
+
+		values, err := applyEnvOnValues(document, chain, substitutionOptions(generator.Config, application, generator.Strict))
+		if err != nil {
+			errs = append(errs, prefixErrors(documentName(i, application), err))
+		}
+		result.Write(values)
+	}
+
+	if len(errs) > 0 {
+		log.Fatalf("Error substituting env:\n%v", errors.Join(errs...))
+	}
+	fmt.Println(result.String())
 }
 
-func applyEnvOnValues(values []byte) []byte {
-	for _, env := range os.Environ() {
-		// For security reason, we will skip all the env that start with ARGOCD_ and KUBERNETES_
-		// These env are set by ArgoCD and Kubernetes and we don't want to expose them in any manifest
-		if strings.HasPrefix(env, "ARGOCD_") || strings.HasPrefix(env, "KUBERNETES_") {
-			log.Printf("Skipping env: %s", env)
-			continue
+// substitutionOptions returns the options to use for an Application, the
+// flags given to the command and the plugin config being overridden by its
+// annotations.
+func substitutionOptions(config *PluginConfig, application Application, strict bool) SubstitutionOptions {
+	options := SubstitutionOptions{
+		Strict: strict,
+		Mode:   config.Substitution.Mode,
+		AVP: AVPOptions{
+			Enabled: config.Substitution.AVP.Enabled,
+			Backend: config.Substitution.AVP.Backend,
+			Path:    application.Metadata.Annotations[avpPathAnnotation],
+		},
+	}
+
+	options.Strict = boolAnnotation(application, strictAnnotation, options.Strict)
+	options.AVP.Enabled = boolAnnotation(application, avpAnnotation, options.AVP.Enabled)
+	if boolAnnotation(application, avpIgnoreAnnotation, false) {
+		options.AVP.Enabled = false
+	}
+
+	delimiters := config.Substitution.Delimiters
+	if value, ok := application.Metadata.Annotations[delimitersAnnotation]; ok {
+		delimiters = value
+	}
+	if len(delimiters) > 0 {
+		parsed, err := parseDelimiters(delimiters)
+		if err != nil {
+			log.Fatalf("Invalid delimiters for %s: %v", application.Metadata.Name, err)
+		}
+		options.Delimiters = parsed
+	}
+
+	paths := strings.Join(config.Substitution.Paths, ",")
+	if value, ok := application.Metadata.Annotations[pathsAnnotation]; ok {
+		paths = value
+	}
+	if len(paths) > 0 {
+		parsed, err := parseYAMLPaths(paths)
+		if err != nil {
+			log.Fatalf("Invalid %s for %s: %v", pathsAnnotation, application.Metadata.Name, err)
 		}
+		options.Paths = parsed
+	}
 
-		pair := strings.SplitN(env, "=", 2)
-		values = bytes.ReplaceAll(values, []byte(fmt.Sprintf("#%s#", pair[0])), []byte(pair[1]))
+	if value, ok := application.Metadata.Annotations[modeAnnotation]; ok {
+		mode, err := parseSubstitutionMode(value)
+		if err != nil {
+			log.Fatalf("Invalid %s annotation on %s: %v", modeAnnotation, application.Metadata.Name, err)
+		}
+		options.Mode = mode
+	}
+
+	return options
+}
+
+// boolAnnotation returns the value of a boolean annotation of an
+// Application, or fallback when it is not set.
+func boolAnnotation(application Application, annotation string, fallback bool) bool {
+	value, ok := application.Metadata.Annotations[annotation]
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s annotation on %s: %v", annotation, application.Metadata.Name, err)
 	}
+	return b
+}
+
+// documentSeparator matches the line separating two YAML documents.
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*(\r?\n|$)`)
+
+// splitDocuments splits a multi-document YAML stream. Each separator is kept
+// at the end of the previous document so that joining the documents gives
+// back the stream, and line numbers stay relative to each document.
+func splitDocuments(content []byte) [][]byte {
+	var documents [][]byte
+	start := 0
+	for _, loc := range documentSeparator.FindAllIndex(content, -1) {
+		documents = append(documents, content[start:loc[1]])
+		start = loc[1]
+	}
+	return append(documents, content[start:])
+}
+
+// documentName names a document of the stdin stream in error messages.
+func documentName(index int, application Application) string {
+	if application.Metadata.Name == "" {
+		return fmt.Sprintf("stdin document %d", index+1)
+	}
+	return fmt.Sprintf("stdin document %d (%s)", index+1, application.Metadata.Name)
+}
+
+func applyEnvOnValues(values []byte, chain *ProviderChain, options SubstitutionOptions) ([]byte, error) {
+	return newChainSubstituter(chain, options).Substitute(values)
+}
 
-	return values
+// newChainSubstituter returns the Substituter resolving placeholders with
+// the providers of a chain.
+func newChainSubstituter(chain *ProviderChain, options SubstitutionOptions) *Substituter {
+	substituter := NewSubstituter(chain.Lookup, options)
+	substituter.secret = chain.Secret
+	return substituter
 }
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvOnValuesArgocdEnv(t *testing.T) {
+	t.Setenv("ARGOCD_ENV_DOMAIN", "app.example.com")
+	t.Setenv("ARGOCD_ENV_REGION", "eu-west-1")
+	t.Setenv("REGION", "us-east-1")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	config := DefaultPluginConfig()
+	config.Variables.Allow = append(config.Variables.Allow, VariableRule{Name: "REGION"})
+
+	values := "domain: #DOMAIN#\nlegacy: #ARGOCD_ENV_DOMAIN#\nregion: ${REGION}\nkey: #AWS_SECRET_ACCESS_KEY#\n"
+	want := "domain: app.example.com\nlegacy: app.example.com\nregion: eu-west-1\nkey: #AWS_SECRET_ACCESS_KEY#\n"
+
+	got, err := applyEnvOnValues([]byte(values), newTestProviderChain(t, config), SubstitutionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyEnvOnValuesProviderChain(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "DB_PASSWORD"), []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "REGION"), []byte("from-file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ARGOCD_ENV_REGION", "from-env")
+
+	config := DefaultPluginConfig()
+	config.Providers = []ProviderConfig{{Type: envProviderType}, {Type: fileProviderType, Path: dir}}
+
+	got, err := applyEnvOnValues([]byte("password: #DB_PASSWORD#\nregion: #REGION#\n"), newTestProviderChain(t, config), SubstitutionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "password: from-file\nregion: from-env\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyEnvOnValuesSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "DB_PASSWORD"), []byte("pa$$word#HOST#${HOST}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ARGOCD_ENV_HOST", "db.local")
+	t.Setenv("ARGOCD_ENV_GREETING", "hello #NOBODY# $$5")
+	t.Setenv("ARGOCD_ENV_BAD", "${NOBODY:?s3cr3t-message}")
+
+	config := DefaultPluginConfig()
+	config.Providers = []ProviderConfig{{Type: envProviderType}, {Type: fileProviderType, Path: dir}}
+	chain := newTestProviderChain(t, config)
+
+	// The secret is taken as is, and the value of a variable is neither
+	// unescaped nor checked by the strict mode
+	got, err := applyEnvOnValues([]byte("password: #DB_PASSWORD#\ngreeting: ${GREETING}\n"), chain, SubstitutionOptions{Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "password: pa$$word#HOST#${HOST}\ngreeting: hello #NOBODY# $$5\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = applyEnvOnValues([]byte("bad: #BAD#\n"), chain, SubstitutionOptions{})
+	if err == nil || strings.Contains(err.Error(), "s3cr3t") || strings.Contains(err.Error(), "NOBODY") {
+		t.Errorf("got error %v, want an error not quoting the value of BAD", err)
+	}
+}
+
+func TestApplyEnvOnValuesFileReferences(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "app")
+	if err := os.Mkdir(allowed, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(allowed, "db-password"), []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "token"), []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "token"), filepath.Join(allowed, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultPluginConfig()
+	config.References.File.AllowedDirs = []string{allowed}
+
+	values := "password: #file:" + allowed + "/db-password#\nshell: ${file:" + allowed + "/db-password|b64enc}\nmissing: ${file:" + allowed + "/missing:-none}\n"
+	got, err := applyEnvOnValues([]byte(values), newTestProviderChain(t, config), SubstitutionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "password: s3cr3t\nshell: czNjcjN0\nmissing: none\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, path := range []string{
+		filepath.Join(allowed, "..", "token"),
+		filepath.Join(allowed, "link"),
+		"token",
+		// A missing file outside of the allowed directories is not
+		// reported as unset, which would tell that it doesn't exist
+		filepath.Join(allowed, "..", "missing"),
+	} {
+		if _, err := applyEnvOnValues([]byte("#file:"+path+"#"), newTestProviderChain(t, config), SubstitutionOptions{}); err == nil {
+			t.Errorf("expected %s to be rejected", path)
+		}
+	}
+}
+
+func newTestProviderChain(t *testing.T, config *PluginConfig) *ProviderChain {
+	chain, err := newProviderChain(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func TestSubstitutionOptionsDelimiters(t *testing.T) {
+	config := DefaultPluginConfig()
+	config.Substitution.Delimiters = "@@..@@"
+
+	application := Application{}
+	if got := substitutionOptions(config, application, false).Delimiters; len(got) != 1 || got[0] != (Delimiters{Open: "@@", Close: "@@"}) {
+		t.Errorf("got %v from the plugin config", got)
+	}
+
+	application.Metadata.Annotations = map[string]string{delimitersAnnotation: "{{env ..}}, #..#"}
+	want := []Delimiters{{Open: "{{env", Close: "}}"}, {Open: "#", Close: "#"}}
+	if got := substitutionOptions(config, application, false).Delimiters; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v from the annotation, want %v", got, want)
+	}
+}
+
+func TestApplyEnvOnValuesPaths(t *testing.T) {
+	t.Setenv("ARGOCD_ENV_DOMAIN", "app.example.com")
+	t.Setenv("ARGOCD_ENV_TOKEN", "s3cr3t")
+
+	config := DefaultPluginConfig()
+	config.Variables.Allow = append(config.Variables.Allow, VariableRule{Name: "HOME"})
+	application := Application{}
+	application.Metadata.Annotations = map[string]string{pathsAnnotation: ".cloudflare.*, .ingress.hosts[*]"}
+	options := substitutionOptions(config, application, true)
+
+	values := `cloudflare:
+  token: "#TOKEN#"
+  domain: www.#DOMAIN#
+ingress:
+  name: "#DOMAIN#"
+  hosts:
+    - "#DOMAIN#"
+    - api.${DOMAIN}
+script: |
+  echo #DOMAIN# ${UNSET:?not checked}
+`
+	want := `cloudflare:
+  token: "s3cr3t"
+  domain: www.app.example.com
+ingress:
+  name: "#DOMAIN#"
+  hosts:
+    - "app.example.com"
+    - api.app.example.com
+script: |
+  echo #DOMAIN# ${UNSET:?not checked}
+`
+	got, err := applyEnvOnValues([]byte(values), newTestProviderChain(t, config), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Strict mode only applies inside the paths
+	_, err = applyEnvOnValues([]byte("cloudflare:\n  zone: \"#ZONE#\"\nother: \"#OTHER#\"\n"), newTestProviderChain(t, config), options)
+	if err == nil || !strings.Contains(err.Error(), "#ZONE# is not set") || strings.Contains(err.Error(), "OTHER") {
+		t.Errorf("expected only #ZONE# to be reported, got %v", err)
+	}
+}
+
+func TestParseYAMLPath(t *testing.T) {
+	tests := map[string]string{
+		".":                  "[]",
+		".cloudflare.*":      "[cloudflare *]",
+		".ingress.hosts[*]":  "[ingress hosts [*]]",
+		".a.list[0][1].name": "[a list [0] [1] name]",
+		".[0].name":          "[[0] name]",
+	}
+	for path, want := range tests {
+		got, err := parseYAMLPath(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if fmt.Sprint([]string(got)) != want {
+			t.Errorf("%s: got %v, want %s", path, got, want)
+		}
+	}
+	for _, path := range []string{"cloudflare", ".a..b", ".a[x]", ".a[0", ".a.[0]"} {
+		if _, err := parseYAMLPath(path); err == nil {
+			t.Errorf("expected %q to be rejected", path)
+		}
+	}
+}
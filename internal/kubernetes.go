@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// kubernetesObject is the part of a Secret or ConfigMap the provider reads.
+type kubernetesObject struct {
+	Data       map[string]string `json:"data"`
+	BinaryData map[string]string `json:"binaryData"`
+}
+
+// kubernetesStatus is the body of an error returned by the API server.
+type kubernetesStatus struct {
+	Message string `json:"message"`
+}
+
+// kubernetesClient reads Secrets and ConfigMaps with the REST API.
+type kubernetesClient struct {
+	host       string
+	token      string
+	namespace  string
+	httpClient *http.Client
+}
+
+// newInClusterKubernetesClient creates a client authenticated with the
+// service account mounted in the pod.
+func newInClusterKubernetesClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) <= 0 || len(port) <= 0 {
+		return nil, fmt.Errorf("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	token, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %w", err)
+	}
+	ca, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("read service account CA: %w", err)
+	}
+	namespace, err := os.ReadFile(namespacePath)
+	if err != nil {
+		return nil, fmt.Errorf("read service account namespace: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s", caPath)
+	}
+	httpClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	return &kubernetesClient{
+		host:       "https://" + net.JoinHostPort(host, port),
+		token:      strings.TrimSpace(string(token)),
+		namespace:  strings.TrimSpace(string(namespace)),
+		httpClient: httpClient,
+	}, nil
+}
+
+// get returns a Secret or a ConfigMap, kind being its resource name.
+func (client *kubernetesClient) get(kind string, namespace string, name string) (*kubernetesObject, error) {
+	path := fmt.Sprintf("%s/api/v1/namespaces/%s/%s/%s", client.host, url.PathEscape(namespace), kind, url.PathEscape(name))
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+client.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		status := kubernetesStatus{}
+		_ = json.Unmarshal(body, &status)
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, fmt.Errorf("%s %s/%s not found", strings.TrimSuffix(kind, "s"), namespace, name)
+		case http.StatusForbidden:
+			return nil, fmt.Errorf("access to %s %s/%s denied, the service account needs the get permission on %s in %s: %s",
+				strings.TrimSuffix(kind, "s"), namespace, name, kind, namespace, status.Message)
+		case http.StatusUnauthorized:
+			return nil, fmt.Errorf("the service account token was rejected: %s", status.Message)
+		}
+		return nil, fmt.Errorf("get %s %s/%s: %s: %s", strings.TrimSuffix(kind, "s"), namespace, name, resp.Status, status.Message)
+	}
+
+	object := kubernetesObject{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, fmt.Errorf("decode %s %s/%s: %w", strings.TrimSuffix(kind, "s"), namespace, name, err)
+	}
+	return &object, nil
+}
+
+// kubernetesProvider resolves the #k8s:secret/namespace/name/key# and
+// #k8s:configmap/namespace/name/key# references. The namespace can be
+// omitted, the one of the service account being used.
+type kubernetesProvider struct {
+	// newClient is called on the first reference, so that a build without
+	// any k8s reference doesn't need a service account
+	newClient func() (*kubernetesClient, error)
+	client    *kubernetesClient
+	// namespaces lists the namespaces that can be read
+	namespaces []string
+	// objects caches the objects read during this run
+	objects map[string]*kubernetesObject
+}
+
+func newKubernetesProvider(config KubernetesReferencesConfig, newClient func() (*kubernetesClient, error)) *kubernetesProvider {
+	return &kubernetesProvider{
+		newClient:  newClient,
+		namespaces: config.Namespaces,
+		objects:    map[string]*kubernetesObject{},
+	}
+}
+
+func (provider *kubernetesProvider) Name() string {
+	return kubernetesReferenceScheme
+}
+
+func (provider *kubernetesProvider) Lookup(reference string) (string, bool, error) {
+	parts := strings.Split(reference, "/")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", false, fmt.Errorf("invalid reference %q, expected secret|configmap/[namespace/]name/key", reference)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", false, fmt.Errorf("invalid reference %q, expected secret|configmap/[namespace/]name/key", reference)
+		}
+	}
+
+	var kind string
+	switch parts[0] {
+	case "secret":
+		kind = "secrets"
+	case "configmap":
+		kind = "configmaps"
+	default:
+		return "", false, fmt.Errorf("invalid reference %q, only secret and configmap are supported", reference)
+	}
+
+	if provider.client == nil {
+		client, err := provider.newClient()
+		if err != nil {
+			return "", false, err
+		}
+		provider.client = client
+	}
+
+	namespace, name, key := provider.client.namespace, parts[len(parts)-2], parts[len(parts)-1]
+	if len(parts) == 4 {
+		namespace = parts[1]
+	}
+	if !provider.namespaceAllowed(namespace) {
+		return "", false, fmt.Errorf("namespace %s is not allowed, see references.k8s.namespaces", namespace)
+	}
+
+	cacheKey := strings.Join([]string{kind, namespace, name}, "/")
+	object, ok := provider.objects[cacheKey]
+	if !ok {
+		var err error
+		if object, err = provider.client.get(kind, namespace, name); err != nil {
+			return "", false, err
+		}
+		provider.objects[cacheKey] = object
+	}
+
+	if value, ok := object.Data[key]; ok {
+		if kind == "configmaps" {
+			return value, true, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", false, fmt.Errorf("decode key %s of %s %s/%s: %w", key, parts[0], namespace, name, err)
+		}
+		return string(decoded), true, nil
+	}
+	if value, ok := object.BinaryData[key]; ok {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", false, fmt.Errorf("decode key %s of %s %s/%s: %w", key, parts[0], namespace, name, err)
+		}
+		return string(decoded), true, nil
+	}
+	return "", false, fmt.Errorf("key %s not found in %s %s/%s", key, parts[0], namespace, name)
+}
+
+// namespaceAllowed tells whether a namespace is listed. No namespace can be
+// read when none is listed, the service account of the repo-server being
+// able to read the Secrets of ArgoCD and of every tenant.
+func (provider *kubernetesProvider) namespaceAllowed(namespace string) bool {
+	for _, allowed := range provider.namespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
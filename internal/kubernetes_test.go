@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newFakeKubernetesAPI(t *testing.T) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/my-ns/secrets/db-creds":
+			password := base64.StdEncoding.EncodeToString([]byte("s3cr3t"))
+			w.Write([]byte(`{"data": {"password": "` + password + `"}}`))
+		case "/api/v1/namespaces/argocd/configmaps/app-config":
+			w.Write([]byte(`{"data": {"region": "eu-west-1"}}`))
+		case "/api/v1/namespaces/kube-system/secrets/admin":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "secrets \"admin\" is forbidden"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestKubernetesProvider(t *testing.T) {
+	server, requests := newFakeKubernetesAPI(t)
+	provider := newKubernetesProvider(KubernetesReferencesConfig{Enabled: true, Namespaces: []string{"my-ns", "argocd"}}, func() (*kubernetesClient, error) {
+		return &kubernetesClient{host: server.URL, token: "sa-token", namespace: "argocd", httpClient: server.Client()}, nil
+	})
+
+	chain := NewProviderChain()
+	chain.references[kubernetesReferenceScheme] = provider
+
+	values := "password: #k8s:secret/my-ns/db-creds/password#\nagain: ${k8s:secret/my-ns/db-creds/password|b64enc}\nregion: #k8s:configmap/app-config/region#\n"
+	got, err := NewSubstituter(chain.Lookup, SubstitutionOptions{}).Substitute([]byte(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "password: s3cr3t\nagain: czNjcjN0\nregion: eu-west-1\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if *requests != 2 {
+		t.Errorf("got %d requests, want 2 as the secret is cached", *requests)
+	}
+}
+
+func TestKubernetesProviderErrors(t *testing.T) {
+	server, _ := newFakeKubernetesAPI(t)
+	newClient := func() (*kubernetesClient, error) {
+		return &kubernetesClient{host: server.URL, token: "sa-token", namespace: "argocd", httpClient: server.Client()}, nil
+	}
+
+	allowed := KubernetesReferencesConfig{Namespaces: []string{"my-ns", "kube-system"}}
+	tests := []struct {
+		reference string
+		config    KubernetesReferencesConfig
+		want      string
+	}{
+		{"secret/kube-system/admin/token", allowed, "access to secret kube-system/admin denied"},
+		{"secret/my-ns/db-creds/username", allowed, "key username not found in secret my-ns/db-creds"},
+		{"secret/my-ns/missing/password", allowed, "secret my-ns/missing not found"},
+		{"secret/my-ns/db-creds/password", KubernetesReferencesConfig{Namespaces: []string{"argocd"}}, "namespace my-ns is not allowed"},
+		{"secret/my-ns/db-creds/password", KubernetesReferencesConfig{}, "namespace my-ns is not allowed"},
+		{"secret/argocd-secret/admin.password", KubernetesReferencesConfig{}, "namespace argocd is not allowed"},
+		{"pod/my-ns/db-creds/password", allowed, "only secret and configmap are supported"},
+		{"secret/password", allowed, "invalid reference"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			_, _, err := newKubernetesProvider(tt.config, newClient).Lookup(tt.reference)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	ociScheme = "oci://"
+
+	ociManifestMediaType  = "application/vnd.oci.image.manifest.v1+json"
+	helmChartLayerType    = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	maxChartArchiveLength = 100 << 20
+)
+
+// ociDigest matches a digest pinning an OCI reference.
+var ociDigest = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ociRegistry pulls Helm charts from an OCI registry, with the distribution
+// API, authenticating with the credentials of the repository config.
+type ociRegistry struct {
+	host       string
+	username   string
+	password   string
+	httpClient *http.Client
+	// token is the bearer token of the repository being pulled
+	token string
+}
+
+// ociReference is a chart in an OCI registry, e.g. oci://ghcr.io/org/charts
+// and mychart.
+type ociReference struct {
+	host       string
+	repository string
+}
+
+// parseOCIReference parses the repoURL and the chart of an Application.
+func parseOCIReference(repoURL string, chart string) (ociReference, error) {
+	location := strings.Trim(strings.TrimPrefix(repoURL, ociScheme), "/")
+	host, repository, _ := strings.Cut(location, "/")
+	if host == "" {
+		return ociReference{}, fmt.Errorf("invalid OCI repository %q", repoURL)
+	}
+	repository = path.Join(repository, chart)
+	if repository == "" || repository == "." {
+		return ociReference{}, fmt.Errorf("no chart in OCI repository %q", repoURL)
+	}
+	return ociReference{host: host, repository: repository}, nil
+}
+
+// splitDigest splits a targetRevision into its version and the digest it
+// is pinned to, e.g. "1.2.3@sha256:..." or "sha256:...".
+func splitDigest(targetRevision string) (string, string, error) {
+	version, digest, ok := strings.Cut(targetRevision, "@")
+	if !ok && ociDigest.MatchString(targetRevision) {
+		return "", targetRevision, nil
+	}
+	if ok && !ociDigest.MatchString(digest) {
+		return "", "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return version, digest, nil
+}
+
+// resolveChartVersion returns the tag to pull for a targetRevision, the
+// constraints being resolved against the tags of the repository.
+func (registry *ociRegistry) resolveChartVersion(ref ociReference, targetRevision string) (string, error) {
+	return resolveVersion(targetRevision, func() ([]string, error) {
+		tags := struct {
+			Tags []string `json:"tags"`
+		}{}
+		if _, err := registry.get(ref, "/tags/list", "application/json", &tags); err != nil {
+			return nil, err
+		}
+		// Helm writes the "+" of a version as "_" in tags
+		for i, tag := range tags.Tags {
+			tags.Tags[i] = strings.ReplaceAll(tag, "_", "+")
+		}
+		return tags.Tags, nil
+	}, ref.host+"/"+ref.repository)
+}
+
+// pull extracts the chart at reference, a tag or a digest, in dir, and
+// returns the digest of its manifest. A digest reference is checked
+// against the manifest.
+func (registry *ociRegistry) pull(ref ociReference, reference string, dir string) (string, error) {
+	manifest := struct {
+		Layers []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+		} `json:"layers"`
+	}{}
+	bs, err := registry.get(ref, "/manifests/"+strings.ReplaceAll(reference, "+", "_"), ociManifestMediaType, &manifest)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256Digest(bs)
+	if ociDigest.MatchString(reference) && digest != reference {
+		return "", fmt.Errorf("manifest of %s has digest %s, expected %s", ref.repository, digest, reference)
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != helmChartLayerType {
+			continue
+		}
+		archive, err := registry.get(ref, "/blobs/"+layer.Digest, "", nil)
+		if err != nil {
+			return "", err
+		}
+		if sha256Digest(archive) != layer.Digest {
+			return "", fmt.Errorf("chart archive of %s does not match its digest %s", ref.repository, layer.Digest)
+		}
+		return digest, extractChart(archive, dir)
+	}
+	return "", fmt.Errorf("%s@%s is not a Helm chart", ref.repository, reference)
+}
+
+// get reads an endpoint of the repository, decoding it into v if not nil,
+// and logs in when the registry asks to.
+func (registry *ociRegistry) get(ref ociReference, endpoint string, accept string, v interface{}) ([]byte, error) {
+	u := fmt.Sprintf("https://%s/v2/%s%s", registry.host, ref.repository, endpoint)
+	resp, err := registry.do(u, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && len(registry.token) <= 0 {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := registry.login(challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = registry.do(u, accept); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%s%s not found in %s", ref.repository, endpoint, registry.host)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, fmt.Errorf("%s: access to %s denied, check the credentials of the repository config", registry.host, ref.repository)
+	default:
+		return nil, fmt.Errorf("%s: GET %s: %s", registry.host, endpoint, resp.Status)
+	}
+
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, maxChartArchiveLength))
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		if err := json.Unmarshal(bs, v); err != nil {
+			return nil, fmt.Errorf("%s: decode %s: %w", registry.host, endpoint, err)
+		}
+	}
+	return bs, nil
+}
+
+func (registry *ociRegistry) do(u string, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", accept)
+	}
+	switch {
+	case len(registry.token) > 0:
+		req.Header.Set("Authorization", "Bearer "+registry.token)
+	case len(registry.username) > 0 || len(registry.password) > 0:
+		req.SetBasicAuth(registry.username, registry.password)
+	}
+
+	httpClient := registry.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", registry.host, err)
+	}
+	return resp, nil
+}
+
+// login gets a bearer token from the realm of a "Bearer" challenge, with
+// the credentials of the repository config if any.
+func (registry *ociRegistry) login(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("%s: access denied, check the credentials of the repository config", registry.host)
+	}
+	attributes := parseChallenge(params)
+	realm, err := url.Parse(attributes["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("%s: invalid authentication realm %q", registry.host, attributes["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value, ok := attributes[key]; ok {
+			query.Set(key, value)
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	resp, err := registry.do(realm.String(), "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: login: %s", registry.host, resp.Status)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("%s: login: %w", registry.host, err)
+	}
+	registry.token = token.Token
+	if len(registry.token) <= 0 {
+		registry.token = token.AccessToken
+	}
+	if len(registry.token) <= 0 {
+		return fmt.Errorf("%s: login: no token returned", registry.host)
+	}
+	redactor.Add(registry.token)
+	return nil
+}
+
+// parseChallenge parses the key="value" attributes of a WWW-Authenticate
+// challenge.
+func parseChallenge(params string) map[string]string {
+	attributes := map[string]string{}
+	for len(params) > 0 {
+		key, rest, ok := strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				break
+			}
+			value, params = rest[1:1+end], rest[2+end:]
+		} else {
+			value, params, _ = strings.Cut(rest, ",")
+		}
+		attributes[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return attributes
+}
+
+func sha256Digest(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// extractChart extracts a chart archive in dir, refusing the entries that
+// would be written outside of it.
+func extractChart(archive []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return fmt.Errorf("read chart archive: %w", err)
+	}
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read chart archive: %w", err)
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("chart archive entry %s is outside of the chart", header.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, io.LimitReader(reader, maxChartArchiveLength))
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
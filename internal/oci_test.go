@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func chartArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// newFakeRegistry serves mychart 1.2.0 and 1.3.0+build in org/charts, behind
+// a bearer token given to user:pass.
+func newFakeRegistry(t *testing.T) (*httptest.Server, map[string]string) {
+	blobs := map[string][]byte{}
+	manifests := map[string][]byte{}
+	digests := map[string]string{}
+	for _, version := range []string{"1.2.0", "1.3.0+build"} {
+		archive := chartArchive(t, map[string]string{
+			"mychart/Chart.yaml":  "apiVersion: v2\nname: mychart\nversion: " + version + "\n",
+			"mychart/values.yaml": "replicas: 1\n",
+		})
+		blobs[sha256Digest(archive)] = archive
+		manifest, _ := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"layers":        []map[string]string{{"mediaType": helmChartLayerType, "digest": sha256Digest(archive)}},
+		})
+		tag := strings.ReplaceAll(version, "+", "_")
+		manifests[tag] = manifest
+		manifests[sha256Digest(manifest)] = manifest
+		digests[version] = sha256Digest(manifest)
+	}
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if username, password, _ := r.BasicAuth(); username != "user" || password != "pass" || r.URL.Query().Get("scope") != "repository:org/charts/mychart:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "registry-token"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:org/charts/mychart:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		prefix := "/v2/org/charts/mychart/"
+		endpoint := strings.TrimPrefix(r.URL.Path, prefix)
+		switch {
+		case endpoint == "tags/list":
+			w.Write([]byte(`{"name": "org/charts/mychart", "tags": ["1.2.0", "1.3.0_build"]}`))
+		case strings.HasPrefix(endpoint, "manifests/") && manifests[strings.TrimPrefix(endpoint, "manifests/")] != nil:
+			w.Write(manifests[strings.TrimPrefix(endpoint, "manifests/")])
+		case strings.HasPrefix(endpoint, "blobs/") && blobs[strings.TrimPrefix(endpoint, "blobs/")] != nil:
+			w.Write(blobs[strings.TrimPrefix(endpoint, "blobs/")])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, digests
+}
+
+func TestOCIRegistryPull(t *testing.T) {
+	server, digests := newFakeRegistry(t)
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	ref, err := parseOCIReference(ociScheme+host+"/org/charts", "mychart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := &ociRegistry{host: ref.host, username: "user", password: "pass", httpClient: server.Client()}
+
+	version, err := registry.resolveChartVersion(ref, "^1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.3.0+build" {
+		t.Errorf("got version %s, want 1.3.0+build", version)
+	}
+
+	dir := t.TempDir()
+	digest, err := registry.pull(ref, version, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != digests["1.3.0+build"] {
+		t.Errorf("got digest %s, want %s", digest, digests["1.3.0+build"])
+	}
+	if chart := ReadChartYaml(filepath.Join(dir, "mychart")); chart["version"] != "1.3.0+build" {
+		t.Errorf("got Chart.yaml %v", chart)
+	}
+
+	// A digest reference pins the manifest
+	dir = t.TempDir()
+	if _, err := registry.pull(ref, digests["1.2.0"], dir); err != nil {
+		t.Fatal(err)
+	}
+	if chart := ReadChartYaml(filepath.Join(dir, "mychart")); chart["version"] != "1.2.0" {
+		t.Errorf("got Chart.yaml %v", chart)
+	}
+	if _, err := registry.pull(ref, "sha256:"+strings.Repeat("0", 64), t.TempDir()); err == nil {
+		t.Error("expected an unknown digest to fail")
+	}
+
+	unauthorized := &ociRegistry{host: ref.host, username: "user", password: "wrong", httpClient: server.Client()}
+	if _, err := unauthorized.pull(ref, "1.2.0", t.TempDir()); err == nil {
+		t.Error("expected wrong credentials to fail")
+	}
+}
+
+func TestSplitDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := map[string][2]string{
+		"1.2.3":           {"1.2.3", ""},
+		digest:            {"", digest},
+		"1.2.3@" + digest: {"1.2.3", digest},
+		">=1.2 <2":        {">=1.2 <2", ""},
+	}
+	for targetRevision, want := range tests {
+		version, got, err := splitDigest(targetRevision)
+		if err != nil || version != want[0] || got != want[1] {
+			t.Errorf("%s: got %q, %q (%v), want %q", targetRevision, version, got, err, want)
+		}
+	}
+	if _, _, err := splitDigest("1.2.3@sha256:short"); err == nil {
+		t.Error("expected an invalid digest to fail")
+	}
+}
+
+func TestExtractChartOutside(t *testing.T) {
+	dir := t.TempDir()
+	archive := chartArchive(t, map[string]string{"../evil": "x"})
+	if err := extractChart(archive, filepath.Join(dir, "charts")); err == nil {
+		t.Fatal("expected an entry outside of the chart to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+		t.Error("entry written outside of the chart")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	got := parseChallenge(`realm="https://ghcr.io/token",service="ghcr.io",scope="repository:org/chart:pull"`)
+	if got["realm"] != "https://ghcr.io/token" || got["service"] != "ghcr.io" || got["scope"] != "repository:org/chart:pull" {
+		t.Errorf("got %v", got)
+	}
+}
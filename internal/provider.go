@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ValueProvider is a source of variables for the placeholders.
+type ValueProvider interface {
+	// Name identifies the provider in the logs
+	Name() string
+	// Lookup returns the value of a variable and whether the provider has it
+	Lookup(name string) (string, bool, error)
+}
+
+// referenceSchemes are the schemes of the placeholders referencing a value
+// by its location rather than by a variable name, e.g. #file:/path#.
+var referenceSchemes = map[string]bool{
+	fileReferenceScheme:       true,
+	kubernetesReferenceScheme: true,
+	vaultReferenceScheme:      true,
+}
+
+// isReference tells whether a placeholder name is a reference, "scheme:location".
+func isReference(name string) bool {
+	scheme, location, ok := strings.Cut(name, ":")
+	return ok && location != "" && referenceSchemes[scheme]
+}
+
+// ProviderChain resolves a variable with the first of its providers that
+// has it, and a reference with the provider registered for its scheme.
+type ProviderChain struct {
+	providers  []ValueProvider
+	references map[string]ValueProvider
+	// dotenv holds the variables of the dotenv files, when the env provider
+	// is in the chain
+	dotenv *dotenvProvider
+	// schema declares the variables of the Applications, if any
+	schema *VariableSchema
+	// resolvedBy records the provider that resolved each variable
+	resolvedBy map[string]string
+	// secrets records the variables resolved from a secret, see Secret
+	secrets map[string]bool
+}
+
+func NewProviderChain(providers ...ValueProvider) *ProviderChain {
+	return &ProviderChain{
+		providers:  providers,
+		references: map[string]ValueProvider{},
+		resolvedBy: map[string]string{},
+		secrets:    map[string]bool{},
+	}
+}
+
+// Lookup implements the Lookup of a Substituter.
+func (chain *ProviderChain) Lookup(name string) (string, bool, error) {
+	if isReference(name) {
+		scheme, location, _ := strings.Cut(name, ":")
+		provider, ok := chain.references[scheme]
+		if !ok {
+			return "", false, fmt.Errorf("%s references are not enabled", scheme)
+		}
+		value, ok, err := provider.Lookup(location)
+		if err != nil {
+			return "", false, fmt.Errorf("%s provider: %w", provider.Name(), err)
+		}
+		if ok {
+			// References point to secret stores
+			redactor.Add(value)
+		}
+		return value, ok, nil
+	}
+
+	for _, provider := range chain.providers {
+		value, ok, err := provider.Lookup(name)
+		if err != nil {
+			return "", false, fmt.Errorf("%s provider: %w", provider.Name(), err)
+		}
+		if !ok {
+			continue
+		}
+		if _, secret := provider.(*fileProvider); secret || chain.schema.sensitive(name) {
+			redactor.Add(value)
+			chain.secrets[name] = true
+		}
+		if _, logged := chain.resolvedBy[name]; !logged {
+			log.Printf("Variable %s resolved by %s provider", name, provider.Name())
+			chain.resolvedBy[name] = provider.Name()
+		}
+		return value, true, nil
+	}
+	return "", false, nil
+}
+
+// ResolvedBy returns the name of the provider that resolved a variable.
+func (chain *ProviderChain) ResolvedBy(name string) (string, bool) {
+	provider, ok := chain.resolvedBy[name]
+	return provider, ok
+}
+
+// Secret tells whether the value of a placeholder is a secret: a reference,
+// a variable of the file provider or a sensitive variable of the schema.
+func (chain *ProviderChain) Secret(name string) bool {
+	return isReference(name) || chain.secrets[name] || chain.schema.sensitive(name)
+}
+
+// loadDotenv reads the dotenv files of the Applications of a directory.
+func (chain *ProviderChain) loadDotenv(dir string) error {
+	if chain.dotenv == nil {
+		return nil
+	}
+	return chain.dotenv.load(dir)
+}
+
+// newProviderChain creates the providers declared in the plugin config.
+func newProviderChain(config *PluginConfig) (*ProviderChain, error) {
+	var providers []ValueProvider
+	var dotenv *dotenvProvider
+	for _, providerConfig := range config.Providers {
+		switch providerConfig.Type {
+		case envProviderType:
+			// The plugin env of the Application and its dotenv files take
+			// precedence over the environment of the sidecar
+			argocdEnv, env := newEnvProviders(&config.Variables)
+			dotenv = &dotenvProvider{defaultFile: config.Dotenv.DefaultFile}
+			providers = append(providers, argocdEnv, dotenv, env)
+		case fileProviderType:
+			providers = append(providers, &fileProvider{dir: providerConfig.Path})
+		default:
+			return nil, fmt.Errorf("unknown provider type %q", providerConfig.Type)
+		}
+	}
+
+	chain := NewProviderChain(providers...)
+	chain.dotenv = dotenv
+	chain.references[fileReferenceScheme] = &fileReferenceProvider{allowedDirs: config.References.File.AllowedDirs}
+	if config.References.K8s.Enabled {
+		chain.references[kubernetesReferenceScheme] = newKubernetesProvider(config.References.K8s, newInClusterKubernetesClient)
+	}
+	if config.References.Vault.Enabled {
+		vault, err := newVaultProvider(config.References.Vault)
+		if err != nil {
+			return nil, err
+		}
+		chain.references[vaultReferenceScheme] = vault
+	}
+	return chain, nil
+}
+
+// envProvider resolves the variables from the environment of the plugin,
+// restricted by the variable policy.
+type envProvider struct {
+	name string
+	envs map[string]string
+}
+
+// newEnvProviders returns the providers of the plugin env of the
+// Application, and of the whole environment of the plugin.
+func newEnvProviders(policy *VariablePolicy) (*envProvider, *envProvider) {
+	envs := map[string]string{}
+	skipped := 0
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+
+		// For security reason, only the env allowed by the plugin config are exposed
+		// The sidecar env also holds Kubernetes settings and possibly cloud credentials
+		if !policy.Allowed(pair[0]) {
+			skipped++
+			continue
+		}
+
+		envs[pair[0]] = pair[1]
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d env not allowed by the plugin config", skipped)
+	}
+
+	// ArgoCD exposes the plugin env of the Application as ARGOCD_ENV_<NAME>,
+	// make them available as <NAME> too. Being set for this Application only,
+	// they take precedence over a sidecar env with the same name.
+	prefix := argocdEnvVarPrefix + "_"
+	argocdEnvs := map[string]string{}
+	for name, value := range envs {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			argocdEnvs[strings.TrimPrefix(name, prefix)] = value
+		}
+	}
+
+	return &envProvider{name: argocdEnvProviderName, envs: argocdEnvs}, &envProvider{name: envProviderType, envs: envs}
+}
+
+func (provider *envProvider) Name() string {
+	return provider.name
+}
+
+func (provider *envProvider) Lookup(name string) (string, bool, error) {
+	value, ok := provider.envs[name]
+	return value, ok, nil
+}
+
+// fileProvider resolves a variable from the file of the same name in a
+// directory, such as a mounted Kubernetes Secret.
+type fileProvider struct {
+	dir string
+}
+
+func (provider *fileProvider) Name() string {
+	return fileProviderType
+}
+
+func (provider *fileProvider) Lookup(name string) (string, bool, error) {
+	bs, err := os.ReadFile(filepath.Join(provider.dir, filepath.Base(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return trimTrailingNewline(string(bs)), true, nil
+}
+
+// trimTrailingNewline removes the newline most editors add at the end of a file.
+func trimTrailingNewline(value string) string {
+	value = strings.TrimSuffix(value, "\n")
+	return strings.TrimSuffix(value, "\r")
+}
+
+// fileReferenceProvider resolves the #file:/path# references, as long as
+// the file is inside one of the allowed directories.
+type fileReferenceProvider struct {
+	allowedDirs []string
+}
+
+func (provider *fileReferenceProvider) Name() string {
+	return fileReferenceScheme
+}
+
+func (provider *fileReferenceProvider) Lookup(path string) (string, bool, error) {
+	if !filepath.IsAbs(path) {
+		return "", false, fmt.Errorf("%s is not an absolute path", path)
+	}
+
+	// The path is checked before touching the filesystem, so that a
+	// reference can't tell whether a file outside of the allowed
+	// directories exists
+	path = filepath.Clean(path)
+	if !provider.allowed(path, false) {
+		return "", false, fmt.Errorf("%s is not in an allowed directory", path)
+	}
+
+	// Symlinks are then resolved and the path checked again, so that a link
+	// can't point outside of the allowed directories
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if !provider.allowed(resolved, true) {
+		return "", false, fmt.Errorf("%s is not in an allowed directory", path)
+	}
+
+	bs, err := os.ReadFile(resolved)
+	if err != nil {
+		return "", false, err
+	}
+	return trimTrailingNewline(string(bs)), true, nil
+}
+
+// allowed tells whether path is inside one of the allowed directories,
+// their symlinks being resolved when resolve is true.
+func (provider *fileReferenceProvider) allowed(path string, resolve bool) bool {
+	for _, dir := range provider.allowedDirs {
+		dir = filepath.Clean(dir)
+		if resolve {
+			resolvedDir, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				continue
+			}
+			dir = resolvedDir
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
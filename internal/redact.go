@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	redactedValue = "*****"
+	// minSecretLength avoids masking every occurrence of a short value such
+	// as "1" or "true" in the logs
+	minSecretLength = 4
+)
+
+// Redactor masks the known secret values in the text it is given.
+type Redactor struct {
+	mu       sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+// redactor is the Redactor every log line goes through, see
+// NewRedactingWriter.
+var redactor = NewRedactor()
+
+func NewRedactor() *Redactor {
+	return &Redactor{secrets: map[string]bool{}, replacer: strings.NewReplacer()}
+}
+
+// Add registers a secret value to mask. Every line of a multi-line value is
+// masked on its own, as errors may only quote part of it.
+func (redactor *Redactor) Add(secret string) {
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+
+	added := false
+	for _, value := range append(strings.Split(secret, "\n"), secret) {
+		value = strings.TrimSpace(value)
+		if len(value) < minSecretLength || redactor.secrets[value] {
+			continue
+		}
+		redactor.secrets[value] = true
+		added = true
+	}
+	if !added {
+		return
+	}
+
+	// The longest secrets are replaced first, so that a secret holding
+	// another one is masked as a whole
+	secrets := make([]string, 0, len(redactor.secrets))
+	for value := range redactor.secrets {
+		secrets = append(secrets, value)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, value := range secrets {
+		pairs = append(pairs, value, redactedValue)
+	}
+	redactor.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact returns text with the secrets masked.
+func (redactor *Redactor) Redact(text string) string {
+	redactor.mu.RLock()
+	defer redactor.mu.RUnlock()
+	return redactor.replacer.Replace(text)
+}
+
+// redactingWriter masks the secrets of everything written to w, each log
+// line being written at once.
+type redactingWriter struct {
+	w        io.Writer
+	redactor *Redactor
+}
+
+// NewRedactingWriter returns a writer masking the secrets registered while
+// running the commands, meant as the output of the log package.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w, redactor: redactor}
+}
+
+func (writer *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(writer.w, writer.redactor.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	redactor := NewRedactor()
+	redactor.Add("s3cr3t")
+	redactor.Add("s3cr3t-longer")
+	redactor.Add("abc")
+	redactor.Add("-----BEGIN KEY-----\nMIIBsecretline\n-----END KEY-----")
+
+	got := redactor.Redact("password s3cr3t, token s3cr3t-longer, short abc, cert line MIIBsecretline")
+	if want := "password *****, token *****, short abc, cert line *****"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRedactingWriterResolvedSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "DB_PASSWORD"), []byte("file-s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	schemaDir := writeSchema(t, "variables:\n  - name: API_TOKEN\n    sensitive: true\n")
+	t.Setenv("ARGOCD_ENV_API_TOKEN", "env-t0ken")
+	t.Setenv("ARGOCD_ENV_DOMAIN", "app.example.com")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "aws-s3cr3t")
+
+	var out bytes.Buffer
+	log.SetOutput(NewRedactingWriter(&out))
+	defer log.SetOutput(os.Stderr)
+
+	config := DefaultPluginConfig()
+	config.Providers = []ProviderConfig{{Type: envProviderType}, {Type: fileProviderType, Path: dir}}
+	chain := newTestProviderChain(t, config)
+	if err := chain.loadSchema(schemaDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyEnvOnValues([]byte("#DB_PASSWORD# #API_TOKEN# #DOMAIN#"), chain, SubstitutionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	log.Printf("values: file-s3cr3t env-t0ken app.example.com")
+	for _, leaked := range []string{"file-s3cr3t", "env-t0ken", "aws-s3cr3t", "AWS_SECRET_ACCESS_KEY"} {
+		if strings.Contains(out.String(), leaked) {
+			t.Errorf("%s leaked in:\n%s", leaked, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "Skipped ") || !strings.Contains(out.String(), "app.example.com") {
+		t.Errorf("expected the skipped env count and the plain values in:\n%s", out.String())
+	}
+}
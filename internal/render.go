@@ -140,16 +140,6 @@ func (renderer *Renderer) RenderTemplate(helmChartPath string, debugLogFilePath
 	// fmt.Println(out.String())
 }
 
-func (renderer *Renderer) envsubst(str string, envs []string) string {
-	for _, env := range envs {
-		envVar := os.Getenv(env)
-		if len(envVar) > 0 {
-			str = strings.Replace(str, "${"+env+"}", envVar, -1)
-		}
-	}
-	return str
-}
-
 func (renderer *Renderer) preparePostRenderer(files []string) string {
 	// Get the current temp path
 	pwd, err := os.Getwd()
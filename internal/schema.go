@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// schemaFile declares the variables expected by the Applications of its
+	// directory
+	schemaFile         = "variables.schema.yaml"
+	schemaProviderType = "schema"
+)
+
+// VariableSchema declares the variables the placeholders of an Application
+// expect, so that a misconfigured environment fails before rendering.
+type VariableSchema struct {
+	Variables []VariableDeclaration `yaml:"variables"`
+}
+
+// VariableDeclaration declares a variable and the values it accepts.
+type VariableDeclaration struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Required    bool   `yaml:"required"`
+	// Type is one of string (default), int, float or bool
+	Type    string   `yaml:"type"`
+	Pattern string   `yaml:"pattern"`
+	Enum    []string `yaml:"enum"`
+	// Default is the value of the variable when no provider has it
+	Default *string `yaml:"default"`
+	// Sensitive variables never have their value shown
+	Sensitive bool `yaml:"sensitive"`
+
+	pattern *regexp.Regexp
+}
+
+// LoadVariableSchema reads the variables.schema.yaml file of a directory,
+// returning nil when there is none.
+func LoadVariableSchema(dir string) (*VariableSchema, error) {
+	path := filepath.Join(dir, schemaFile)
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schema := VariableSchema{}
+	if err := yaml.UnmarshalStrict(bs, &schema); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %w", path, err)
+	}
+	if err := schema.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &schema, nil
+}
+
+func (schema *VariableSchema) compile() error {
+	names := map[string]bool{}
+	for i := range schema.Variables {
+		variable := &schema.Variables[i]
+		if !placeholderName.MatchString(variable.Name) {
+			return fmt.Errorf("invalid variable name %q", variable.Name)
+		}
+		if names[variable.Name] {
+			return fmt.Errorf("variable %s is declared twice", variable.Name)
+		}
+		names[variable.Name] = true
+
+		switch variable.Type {
+		case "":
+			variable.Type = "string"
+		case "string", "int", "float", "bool":
+		default:
+			return fmt.Errorf("variable %s: unknown type %q, expected string, int, float or bool", variable.Name, variable.Type)
+		}
+		if len(variable.Pattern) > 0 {
+			pattern, err := regexp.Compile("^(?:" + variable.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("variable %s: pattern: %w", variable.Name, err)
+			}
+			variable.pattern = pattern
+		}
+	}
+	return nil
+}
+
+// Validate checks the value of every declared variable, their default
+// included, and returns all the violations at once.
+func (schema *VariableSchema) Validate(lookup Lookup) error {
+	var errs []error
+	for _, variable := range schema.Variables {
+		value, ok, err := lookup(variable.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", variable.Name, err))
+			continue
+		}
+		if !ok && variable.Default != nil {
+			value, ok = *variable.Default, true
+		}
+		if !ok {
+			if variable.Required {
+				errs = append(errs, fmt.Errorf("%s is required%s", variable.Name, variable.describe()))
+			}
+			continue
+		}
+		errs = append(errs, variable.validate(value)...)
+	}
+	return errors.Join(errs...)
+}
+
+func (variable VariableDeclaration) validate(value string) []error {
+	shown := fmt.Sprintf(" %q", value)
+	if variable.Sensitive {
+		shown = ""
+	}
+
+	var errs []error
+	switch variable.Type {
+	case "int":
+		if !intValue.MatchString(value) {
+			errs = append(errs, fmt.Errorf("%s: value%s is not an int", variable.Name, shown))
+		}
+	case "float":
+		if !intValue.MatchString(value) && !floatValue.MatchString(value) {
+			errs = append(errs, fmt.Errorf("%s: value%s is not a float", variable.Name, shown))
+		}
+	case "bool":
+		if !boolValue.MatchString(value) {
+			errs = append(errs, fmt.Errorf("%s: value%s is not a bool", variable.Name, shown))
+		}
+	}
+	if variable.pattern != nil && !variable.pattern.MatchString(value) {
+		errs = append(errs, fmt.Errorf("%s: value%s does not match %s", variable.Name, shown, variable.Pattern))
+	}
+	if len(variable.Enum) > 0 {
+		allowed := false
+		for _, option := range variable.Enum {
+			allowed = allowed || option == value
+		}
+		if !allowed {
+			errs = append(errs, fmt.Errorf("%s: value%s is not one of %v", variable.Name, shown, variable.Enum))
+		}
+	}
+	return errs
+}
+
+// describe returns the description of a variable for error messages.
+func (variable VariableDeclaration) describe() string {
+	if len(variable.Description) <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", variable.Description)
+}
+
+// schemaProvider resolves the declared variables to their default.
+type schemaProvider struct {
+	schema *VariableSchema
+}
+
+func (provider *schemaProvider) Name() string {
+	return schemaProviderType
+}
+
+func (provider *schemaProvider) Lookup(name string) (string, bool, error) {
+	for _, variable := range provider.schema.Variables {
+		if variable.Name == name && variable.Default != nil {
+			return *variable.Default, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// sensitive tells whether a variable is declared as sensitive.
+func (schema *VariableSchema) sensitive(name string) bool {
+	if schema == nil {
+		return false
+	}
+	for _, variable := range schema.Variables {
+		if variable.Name == name {
+			return variable.Sensitive
+		}
+	}
+	return false
+}
+
+// loadSchema reads the schema of the Applications of a directory, and
+// registers the defaults of its variables as the last provider of the chain.
+func (chain *ProviderChain) loadSchema(dir string) error {
+	schema, err := LoadVariableSchema(dir)
+	if err != nil || schema == nil {
+		return err
+	}
+	chain.providers = append(chain.providers, &schemaProvider{schema: schema})
+	chain.schema = schema
+	return nil
+}
+
+// validateSchema checks the variables against the schema, if any.
+func (chain *ProviderChain) validateSchema() error {
+	if chain.schema == nil {
+		return nil
+	}
+	return chain.schema.Validate(chain.Lookup)
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSchema(t *testing.T, schema string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, schemaFile), []byte(schema), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestVariableSchema(t *testing.T) {
+	dir := writeSchema(t, `variables:
+  - name: DOMAIN
+    description: Public domain of the app
+    required: true
+    pattern: '[a-z.]+'
+  - name: REPLICAS
+    type: int
+    default: 2
+  - name: ENVIRONMENT
+    enum: [staging, production]
+  - name: TOKEN
+    required: true
+    sensitive: true
+    pattern: 'tk-.*'
+  - name: DEBUG
+    type: bool
+`)
+	t.Setenv("ARGOCD_ENV_ENVIRONMENT", "dev")
+	t.Setenv("ARGOCD_ENV_TOKEN", "s3cr3t")
+	t.Setenv("ARGOCD_ENV_DEBUG", "yes")
+
+	chain := newTestProviderChain(t, DefaultPluginConfig())
+	if err := chain.loadSchema(dir); err != nil {
+		t.Fatal(err)
+	}
+	err := chain.validateSchema()
+	if err == nil {
+		t.Fatal("expected violations")
+	}
+
+	// Every violation is reported at once
+	for _, violation := range []string{
+		"DOMAIN is required (Public domain of the app)",
+		`ENVIRONMENT: value "dev" is not one of [staging production]`,
+		"TOKEN: value does not match tk-.*",
+		`DEBUG: value "yes" is not a bool`,
+	} {
+		if !strings.Contains(err.Error(), violation) {
+			t.Errorf("expected %q in:\n%v", violation, err)
+		}
+	}
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("sensitive value leaked in:\n%v", err)
+	}
+	if strings.Contains(err.Error(), "REPLICAS") {
+		t.Errorf("expected the default of REPLICAS to be valid:\n%v", err)
+	}
+}
+
+func TestVariableSchemaDefaults(t *testing.T) {
+	dir := writeSchema(t, `variables:
+  - name: REPLICAS
+    type: int
+    default: "2"
+  - name: DOMAIN
+    default: default.example.com
+`)
+	t.Setenv("ARGOCD_ENV_DOMAIN", "app.example.com")
+
+	chain := newTestProviderChain(t, DefaultPluginConfig())
+	if err := chain.loadSchema(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.validateSchema(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := applyEnvOnValues([]byte("replicas: #REPLICAS#\ndomain: #DOMAIN#\n"), chain, SubstitutionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "replicas: 2\ndomain: app.example.com\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLoadVariableSchemaInvalid(t *testing.T) {
+	for _, schema := range []string{
+		"variables:\n  - name: A\n    type: list\n",
+		"variables:\n  - name: A\n  - name: A\n",
+		"variables:\n  - name: A\n    pattern: '('\n",
+		"variables:\n  - name: A\n    unknown: true\n",
+	} {
+		if _, err := LoadVariableSchema(writeSchema(t, schema)); err == nil {
+			t.Errorf("expected %q to be rejected", schema)
+		}
+	}
+
+	schema, err := LoadVariableSchema(t.TempDir())
+	if err != nil || schema != nil {
+		t.Errorf("expected no schema, got %v (%v)", schema, err)
+	}
+}
@@ -0,0 +1,367 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sopsAgeKeyEnv     = "SOPS_AGE_KEY"
+	sopsAgeKeyFileEnv = "SOPS_AGE_KEY_FILE"
+	sopsMetadataKey   = "sops"
+)
+
+var (
+	// sopsEncryptedValue matches a value encrypted by SOPS
+	sopsEncryptedValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.+),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+	// sopsMACOnlyEncryptedInitialization is written first in the MAC of the
+	// files encrypted with mac_only_encrypted
+	sopsMACOnlyEncryptedInitialization = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+)
+
+// sopsMetadata is the part of the sops block needed to decrypt a file with age.
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified      string `yaml:"lastmodified"`
+	MAC               string `yaml:"mac"`
+	MACOnlyEncrypted  bool   `yaml:"mac_only_encrypted"`
+	UnencryptedSuffix string `yaml:"unencrypted_suffix"`
+	EncryptedSuffix   string `yaml:"encrypted_suffix"`
+	UnencryptedRegex  string `yaml:"unencrypted_regex"`
+	EncryptedRegex    string `yaml:"encrypted_regex"`
+}
+
+// isSOPSEncrypted tells whether a YAML document was encrypted by SOPS,
+// which adds a sops block holding a MAC.
+func isSOPSEncrypted(values []byte) bool {
+	document := struct {
+		SOPS *struct {
+			MAC string `yaml:"mac"`
+		} `yaml:"sops"`
+	}{}
+	if err := yaml.Unmarshal(values, &document); err != nil {
+		return false
+	}
+	return document.SOPS != nil && len(document.SOPS.MAC) > 0
+}
+
+// loadAgeIdentities reads the age keys from the configured key file, then
+// from $SOPS_AGE_KEY and the file at $SOPS_AGE_KEY_FILE.
+func loadAgeIdentities(config SOPSConfig) ([]age.Identity, error) {
+	var keys [][]byte
+	for _, path := range []string{config.AgeKeyFile, os.Getenv(sopsAgeKeyFileEnv)} {
+		if len(path) <= 0 {
+			continue
+		}
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read age key file: %w", err)
+		}
+		keys = append(keys, bs)
+	}
+	if key := os.Getenv(sopsAgeKeyEnv); len(key) > 0 {
+		keys = append(keys, []byte(key))
+	}
+	if len(keys) <= 0 {
+		return nil, fmt.Errorf("no age key, set sops.ageKeyFile in the plugin config, $%s or $%s", sopsAgeKeyFileEnv, sopsAgeKeyEnv)
+	}
+
+	var identities []age.Identity
+	for _, key := range keys {
+		parsed, err := age.ParseIdentities(bytes.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("parse age keys: %w", err)
+		}
+		identities = append(identities, parsed...)
+	}
+	return identities, nil
+}
+
+// decryptSOPS decrypts a YAML document encrypted by SOPS with age, in
+// memory, and checks its MAC. The returned document has no sops block.
+// Errors never include decrypted values.
+func decryptSOPS(values []byte, identities []age.Identity) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(values, &document); err != nil {
+		return nil, fmt.Errorf("parse SOPS file: %w", err)
+	}
+	if len(document.Content) != 1 || document.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("SOPS file is not a YAML mapping")
+	}
+	root := document.Content[0]
+
+	metadata := sopsMetadata{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == sopsMetadataKey {
+			if err := root.Content[i+1].Decode(&metadata); err != nil {
+				return nil, fmt.Errorf("parse sops metadata: %w", err)
+			}
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+			break
+		}
+	}
+
+	dataKey, err := sopsDataKey(metadata, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypter := &sopsDecrypter{metadata: metadata, key: dataKey, hash: sha512.New()}
+	if metadata.MACOnlyEncrypted {
+		decrypter.hash.Write(sopsMACOnlyEncryptedInitialization)
+	}
+	if err := decrypter.walk(root, nil); err != nil {
+		return nil, err
+	}
+
+	// The MAC is encrypted with the last modification date as additional data
+	lastModified, err := time.Parse(time.RFC3339, metadata.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("parse sops lastmodified: %w", err)
+	}
+	mac, _, err := decrypter.decrypt(metadata.MAC, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt sops MAC: %w", err)
+	}
+	if mac != fmt.Sprintf("%X", decrypter.hash.Sum(nil)) {
+		return nil, fmt.Errorf("SOPS file was modified, MAC mismatch")
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, fmt.Errorf("encode decrypted SOPS file: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("encode decrypted SOPS file: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// sopsDataKey decrypts the key the values are encrypted with.
+func sopsDataKey(metadata sopsMetadata, identities []age.Identity) ([]byte, error) {
+	if len(metadata.Age) <= 0 {
+		return nil, fmt.Errorf("SOPS file has no age recipient")
+	}
+	var errs []error
+	for _, recipient := range metadata.Age {
+		reader, err := age.Decrypt(armor.NewReader(strings.NewReader(recipient.Enc)), identities...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", recipient.Recipient, err))
+			continue
+		}
+		return io.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("no age key can decrypt the SOPS data key: %w", errors.Join(errs...))
+}
+
+type sopsDecrypter struct {
+	metadata sopsMetadata
+	key      []byte
+	hash     hash.Hash
+}
+
+// walk decrypts the values of a node in the order SOPS computes the MAC,
+// path being the keys leading to the node.
+func (decrypter *sopsDecrypter) walk(node *yaml.Node, path []string) error {
+	node.HeadComment = stripSOPSComments(node.HeadComment)
+	node.LineComment = stripSOPSComments(node.LineComment)
+	node.FootComment = stripSOPSComments(node.FootComment)
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			key.HeadComment = stripSOPSComments(key.HeadComment)
+			key.LineComment = stripSOPSComments(key.LineComment)
+			key.FootComment = stripSOPSComments(key.FootComment)
+			if err := decrypter.walk(node.Content[i+1], append(path[:len(path):len(path)], key.Value)); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := decrypter.walk(item, path); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		return decrypter.leaf(node, path)
+	}
+	return nil
+}
+
+func (decrypter *sopsDecrypter) leaf(node *yaml.Node, path []string) error {
+	if node.ShortTag() == "!!null" {
+		return nil
+	}
+
+	encrypted := decrypter.encrypted(path)
+	var plain string
+	if encrypted {
+		value, tag, err := decrypter.decrypt(node.Value, strings.Join(path, ":")+":")
+		if err != nil {
+			return fmt.Errorf("decrypt %s: %w", strings.Join(path, "."), err)
+		}
+		node.Value, node.Tag, node.Style = value, tag, 0
+		redactor.Add(value)
+		if tag == "" {
+			node.Tag = strTag
+		}
+	}
+
+	// The MAC is computed on the values as SOPS writes them back
+	switch node.ShortTag() {
+	case intTag:
+		i, err := strconv.Atoi(node.Value)
+		if err != nil {
+			return fmt.Errorf("decrypt %s: invalid int", strings.Join(path, "."))
+		}
+		plain = strconv.Itoa(i)
+	case floatTag:
+		f, err := strconv.ParseFloat(node.Value, 64)
+		if err != nil {
+			return fmt.Errorf("decrypt %s: invalid float", strings.Join(path, "."))
+		}
+		plain = strconv.FormatFloat(f, 'f', -1, 64)
+	case boolTag:
+		b, err := strconv.ParseBool(node.Value)
+		if err != nil {
+			return fmt.Errorf("decrypt %s: invalid bool", strings.Join(path, "."))
+		}
+		plain = "False"
+		if b {
+			plain = "True"
+		}
+	default:
+		plain = node.Value
+	}
+
+	if !decrypter.metadata.MACOnlyEncrypted || encrypted {
+		decrypter.hash.Write([]byte(plain))
+	}
+	return nil
+}
+
+// encrypted tells whether the value at path was encrypted, according to
+// the suffix and regex settings the file was encrypted with.
+func (decrypter *sopsDecrypter) encrypted(path []string) bool {
+	metadata := decrypter.metadata
+	encrypted := true
+	if metadata.UnencryptedSuffix != "" {
+		for _, key := range path {
+			if strings.HasSuffix(key, metadata.UnencryptedSuffix) {
+				encrypted = false
+				break
+			}
+		}
+	}
+	if metadata.EncryptedSuffix != "" {
+		encrypted = false
+		for _, key := range path {
+			if strings.HasSuffix(key, metadata.EncryptedSuffix) {
+				encrypted = true
+				break
+			}
+		}
+	}
+	if metadata.UnencryptedRegex != "" {
+		for _, key := range path {
+			if matched, _ := regexp.MatchString(metadata.UnencryptedRegex, key); matched {
+				encrypted = false
+				break
+			}
+		}
+	}
+	if metadata.EncryptedRegex != "" {
+		encrypted = false
+		for _, key := range path {
+			if matched, _ := regexp.MatchString(metadata.EncryptedRegex, key); matched {
+				encrypted = true
+				break
+			}
+		}
+	}
+	return encrypted
+}
+
+// decrypt decrypts a SOPS value and returns it with the YAML tag of its type.
+func (decrypter *sopsDecrypter) decrypt(value string, additionalData string) (string, string, error) {
+	if value == "" {
+		return "", strTag, nil
+	}
+	matches := sopsEncryptedValue.FindStringSubmatch(value)
+	if matches == nil {
+		return "", "", fmt.Errorf("value is not encrypted")
+	}
+
+	var parts [3][]byte
+	for i := range parts {
+		decoded, err := base64.StdEncoding.DecodeString(matches[i+1])
+		if err != nil {
+			return "", "", fmt.Errorf("invalid encrypted value: %w", err)
+		}
+		parts[i] = decoded
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(decrypter.key)
+	if err != nil {
+		return "", "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", "", err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", "", fmt.Errorf("authentication failed")
+	}
+
+	switch matches[4] {
+	case "str", "bytes":
+		return string(plain), strTag, nil
+	case "int":
+		return string(plain), intTag, nil
+	case "float":
+		return string(plain), floatTag, nil
+	case "bool":
+		return string(plain), boolTag, nil
+	}
+	return "", "", fmt.Errorf("unsupported type %s", matches[4])
+}
+
+// stripSOPSComments removes the comments encrypted by SOPS.
+func stripSOPSComments(comment string) string {
+	if !strings.Contains(comment, "ENC[AES256_GCM,") {
+		return comment
+	}
+	var lines []string
+	for _, line := range strings.Split(comment, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#ENC[AES256_GCM,") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
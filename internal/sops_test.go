@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+func readSOPSFixture(t *testing.T) ([]byte, []age.Identity) {
+	values, err := os.ReadFile("testdata/sops/values.enc.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(sopsAgeKeyFileEnv, "testdata/sops/age.key")
+	t.Setenv(sopsAgeKeyEnv, "")
+	identities, err := loadAgeIdentities(SOPSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values, identities
+}
+
+func TestDecryptSOPS(t *testing.T) {
+	values, identities := readSOPSFixture(t)
+	if !isSOPSEncrypted(values) {
+		t.Fatal("expected the fixture to be detected as SOPS encrypted")
+	}
+
+	decrypted, err := decryptSOPS(values, identities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isSOPSEncrypted(decrypted) || strings.Contains(string(decrypted), "ENC[") {
+		t.Fatalf("expected no SOPS data left, got:\n%s", decrypted)
+	}
+
+	got := map[string]interface{}{}
+	if err := yaml.Unmarshal(decrypted, &got); err != nil {
+		t.Fatal(err)
+	}
+	database := got["database"].(map[string]interface{})
+	expected := map[string]interface{}{
+		"host":     "db.local",
+		"password": "s3cr3t",
+		"port":     5432,
+		"ratio":    1.5,
+		"enabled":  true,
+		"empty":    "",
+		"nothing":  nil,
+		"cert":     "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	}
+	for key, value := range expected {
+		if database[key] != value {
+			t.Errorf("database.%s: expected %#v, got %#v", key, value, database[key])
+		}
+	}
+	if hosts := database["hosts"].([]interface{}); len(hosts) != 2 || hosts[0] != "a.local" || hosts[1] != "b.local" {
+		t.Errorf("database.hosts: got %v", hosts)
+	}
+	if got["replicaCount_unencrypted"] != 2 {
+		t.Errorf("replicaCount_unencrypted: got %v", got["replicaCount_unencrypted"])
+	}
+}
+
+func TestDecryptSOPSModified(t *testing.T) {
+	values, identities := readSOPSFixture(t)
+
+	// An unencrypted value is covered by the MAC
+	modified := strings.Replace(string(values), "replicaCount_unencrypted: 2", "replicaCount_unencrypted: 3", 1)
+	if modified == string(values) {
+		t.Fatal("expected the fixture to hold replicaCount_unencrypted: 2")
+	}
+	_, err := decryptSOPS([]byte(modified), identities)
+	if err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+		t.Fatalf("expected a MAC mismatch, got %v", err)
+	}
+}
+
+func TestDecryptSOPSWrongKey(t *testing.T) {
+	values, _ := readSOPSFixture(t)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decryptSOPS(values, []age.Identity{identity})
+	if err == nil || !strings.Contains(err.Error(), "no age key can decrypt") {
+		t.Fatalf("expected a key error, got %v", err)
+	}
+}
+
+func TestLoadAgeIdentitiesMissing(t *testing.T) {
+	t.Setenv(sopsAgeKeyFileEnv, "")
+	t.Setenv(sopsAgeKeyEnv, "")
+	if _, err := loadAgeIdentities(SOPSConfig{}); err == nil {
+		t.Fatal("expected an error without age key")
+	}
+
+	key, err := os.ReadFile("testdata/sops/age.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(sopsAgeKeyEnv, string(key))
+	identities, err := loadAgeIdentities(SOPSConfig{})
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("expected one identity from $%s, got %d (%v)", sopsAgeKeyEnv, len(identities), err)
+	}
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// appSourceRepoURLEnv is set by ArgoCD to the repository of the checkout
+// the plugin runs in
+const appSourceRepoURLEnv = "ARGOCD_APP_SOURCE_REPO_URL"
+
+// sources returns the sources of an Application, spec.sources replacing
+// spec.source when set.
+func (spec Spec) sources() []Source {
+	if len(spec.Sources) > 0 {
+		return spec.Sources
+	}
+	return []Source{spec.Source}
+}
+
+// resolveRefs maps the ref sources of an Application to a local directory,
+// the root of the checkout.
+func resolveRefs(sources []Source, manifestDir string) (map[string]string, error) {
+	refs := map[string]string{}
+	for _, source := range sources {
+		if len(source.Ref) <= 0 {
+			continue
+		}
+		if _, ok := refs[source.Ref]; ok {
+			return nil, fmt.Errorf("ref %s is declared twice", source.Ref)
+		}
+		root, err := checkoutRoot(source, manifestDir)
+		if err != nil {
+			return nil, fmt.Errorf("ref %s: %w", source.Ref, err)
+		}
+		refs[source.Ref] = root
+	}
+	return refs, nil
+}
+
+// checkoutRoot returns the root of the checkout a git source is read from.
+// Only the repository checked out by ArgoCD is available to the plugin, so
+// the source must point to it.
+func checkoutRoot(source Source, manifestDir string) (string, error) {
+	if repoURL := os.Getenv(appSourceRepoURLEnv); len(repoURL) > 0 && !sameRepository(source.RepoURL, repoURL) {
+		return "", fmt.Errorf("%s is not available, only the checkout of %s is", source.RepoURL, repoURL)
+	}
+	root, ok := repositoryRoot(manifestDir)
+	if !ok {
+		log.Printf("No git repository found for %s, using %s", source.RepoURL, manifestDir)
+		root = manifestDir
+	}
+	return root, nil
+}
+
+// localSourcePath returns the path of a source in the checkout, a chart
+// directory or a packaged .tgz chart.
+func localSourcePath(source Source, manifestDir string) (string, error) {
+	root, err := checkoutRoot(source, manifestDir)
+	if err != nil {
+		return "", err
+	}
+	sourcePath := filepath.Join(root, source.Path)
+	if !insideDir(root, sourcePath) {
+		return "", fmt.Errorf("path %s is outside of the repository", source.Path)
+	}
+	return sourcePath, nil
+}
+
+// archiveChartDir returns the directory of the chart extracted from a
+// packaged chart in dir.
+func archiveChartDir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		chartPath := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(chartPath, "Chart.yaml")); entry.IsDir() && err == nil {
+			return chartPath, nil
+		}
+	}
+	return "", fmt.Errorf("no Chart.yaml found in the archive")
+}
+
+// sameRepository compares two git repository URLs, ignoring the case, the
+// trailing slash and the .git suffix.
+func sameRepository(a string, b string) bool {
+	normalize := func(url string) string {
+		url = strings.TrimSuffix(strings.ToLower(url), "/")
+		return strings.TrimSuffix(url, ".git")
+	}
+	return normalize(a) == normalize(b)
+}
+
+// valueFilePath returns the path of a value file. A $ref/ prefix reads it
+// from the checkout of a ref source, otherwise it is looked up next to the
+// Application manifests, then in the chart. The file must stay inside the
+// checkout, or the chart, so that an Application can't read the files of
+// the plugin, such as its service account token.
+func valueFilePath(valueFile string, refs map[string]string, manifestDir string, chartPath string) (string, error) {
+	if strings.HasPrefix(valueFile, "$") {
+		ref, file, _ := strings.Cut(valueFile[1:], "/")
+		root, ok := refs[ref]
+		if !ok {
+			return "", fmt.Errorf("value file %s: no source has ref %s", valueFile, ref)
+		}
+		valuesPath := filepath.Join(root, file)
+		if !insideDir(root, valuesPath) {
+			return "", fmt.Errorf("value file %s is outside of the ref source", valueFile)
+		}
+		return valuesPath, nil
+	}
+
+	root, ok := repositoryRoot(manifestDir)
+	if !ok {
+		root = manifestDir
+	}
+	valuesPath := filepath.Join(manifestDir, valueFile)
+	if _, err := os.Stat(valuesPath); os.IsNotExist(err) {
+		root, valuesPath = chartPath, filepath.Join(chartPath, valueFile)
+	}
+	if !insideDir(root, valuesPath) {
+		return "", fmt.Errorf("value file %s is outside of the repository", valueFile)
+	}
+	return valuesPath, nil
+}
+
+// insideDir tells whether path is inside dir, once their symlinks are
+// resolved when they exist.
+func insideDir(dir string, path string) bool {
+	inside := func(dir string, path string) bool {
+		rel, err := filepath.Rel(dir, path)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	if !inside(dir, path) {
+		return false
+	}
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return true
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return true
+	}
+	return inside(resolvedDir, resolved)
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestSpecSources(t *testing.T) {
+	manifest := `spec:
+  sources:
+    - repoURL: https://cloudflare.github.io/helm-charts
+      chart: cloudflare-tunnel
+      targetRevision: 0.3.2
+      helm:
+        valueFiles:
+          - $values/apps/cloudflare/values.yaml
+    - repoURL: https://github.com/org/deploy.git
+      targetRevision: main
+      ref: values
+`
+	application := Application{}
+	if err := yaml.Unmarshal([]byte(manifest), &application); err != nil {
+		t.Fatal(err)
+	}
+	sources := application.Spec.sources()
+	if len(sources) != 2 || sources[0].Chart != "cloudflare-tunnel" || sources[1].Ref != "values" {
+		t.Errorf("unexpected sources %+v", sources)
+	}
+
+	single := Spec{Source: Source{Chart: "cloudflare-tunnel"}}
+	if sources := single.sources(); len(sources) != 1 || sources[0].Chart != "cloudflare-tunnel" {
+		t.Errorf("unexpected sources %+v", sources)
+	}
+}
+
+func TestValueFilePath(t *testing.T) {
+	root := t.TempDir()
+	manifestDir := filepath.Join(root, "apps")
+	chartPath := filepath.Join(root, "chart")
+	for _, dir := range []string{filepath.Join(root, ".git"), manifestDir, chartPath} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(manifestDir, "values.yaml"), []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(appSourceRepoURLEnv, "https://github.com/org/deploy")
+	sources := []Source{
+		{RepoURL: "https://cloudflare.github.io/helm-charts", Chart: "cloudflare-tunnel"},
+		{RepoURL: "https://github.com/org/deploy.git", Ref: "values"},
+	}
+	refs, err := resolveRefs(sources, manifestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		valueFile string
+		want      string
+	}{
+		{"$values/envs/prod.yaml", filepath.Join(root, "envs", "prod.yaml")},
+		{"values.yaml", filepath.Join(manifestDir, "values.yaml")},
+		{"values-prod.yaml", filepath.Join(chartPath, "values-prod.yaml")},
+	}
+	for _, test := range tests {
+		got, err := valueFilePath(test.valueFile, refs, manifestDir, chartPath)
+		if err != nil {
+			t.Errorf("%s: %v", test.valueFile, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.valueFile, got, test.want)
+		}
+	}
+
+	outside := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(outside, []byte("sa-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(manifestDir, "link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	for _, valueFile := range []string{
+		"$other/values.yaml",
+		"$values/../secrets.yaml",
+		"../../../var/run/secrets/kubernetes.io/serviceaccount/token",
+		"link.yaml",
+	} {
+		if _, err := valueFilePath(valueFile, refs, manifestDir, chartPath); err == nil {
+			t.Errorf("expected %s to be rejected", valueFile)
+		}
+	}
+
+	sources[1].RepoURL = "https://github.com/org/other"
+	if _, err := resolveRefs(sources, manifestDir); err == nil {
+		t.Error("expected a ref to another repository to be rejected")
+	}
+}
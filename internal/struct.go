@@ -1,19 +1,68 @@
 package internal
 
+const (
+	// strictAnnotation enables strict mode for a single Application
+	strictAnnotation = "envsubst.plugin/strict"
+	// modeAnnotation sets the substitution mode (text or yaml) of an Application
+	modeAnnotation = "envsubst.plugin/mode"
+	// avpAnnotation enables the argocd-vault-plugin placeholders of an Application
+	avpAnnotation = "envsubst.plugin/avp"
+	// delimitersAnnotation sets the placeholder delimiters of an Application
+	delimitersAnnotation = "envsubst.plugin/delimiters"
+	// pathsAnnotation restricts the substitution of an Application to some
+	// YAML paths, as a comma separated list
+	pathsAnnotation = "envsubst.plugin/paths"
+)
+
 type Metadata struct {
-	Name      string `yaml:"name"`
-	Namespace string `yaml:"namespace"`
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace"`
+	Annotations map[string]string `yaml:"annotations"`
 }
 
 type Helm struct {
-	Values string `yaml:"values"`
+	ValueFiles []string `yaml:"valueFiles"`
+	// IgnoreMissingValueFiles skips the value files that don't exist
+	IgnoreMissingValueFiles bool   `yaml:"ignoreMissingValueFiles"`
+	Values                  string `yaml:"values"`
+	// ValuesObject replaces Values when set
+	ValuesObject   map[string]interface{} `yaml:"valuesObject"`
+	Parameters     []HelmParameter        `yaml:"parameters"`
+	FileParameters []HelmFileParameter    `yaml:"fileParameters"`
+	// ReleaseName defaults to the name of the Application
+	ReleaseName string `yaml:"releaseName"`
+	SkipCrds    bool   `yaml:"skipCrds"`
+	// PassCredentials passes the repository credentials to the domain
+	// serving the chart archive
+	PassCredentials bool `yaml:"passCredentials"`
+	// Namespace defaults to the destination namespace
+	Namespace string `yaml:"namespace"`
+}
+
+// HelmParameter is a value set with --set, or --set-string when ForceString is true.
+type HelmParameter struct {
+	Name        string `yaml:"name"`
+	Value       string `yaml:"value"`
+	ForceString bool   `yaml:"forceString"`
+}
+
+// HelmFileParameter is a value read from a file with --set-file.
+type HelmFileParameter struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
 }
 
 type Source struct {
 	RepoURL        string `yaml:"repoURL"`
 	Chart          string `yaml:"chart"`
 	TargetRevision string `yaml:"targetRevision"`
-	Helm           Helm   `yaml:"helm"`
+	// Path is a chart directory or a packaged .tgz chart of the repository,
+	// rendered when the source has no chart
+	Path string `yaml:"path"`
+	Helm Helm   `yaml:"helm"`
+	// Ref names a source of a multi-source Application, so that the value
+	// files of the other sources can be read from it with $ref/path
+	Ref string `yaml:"ref"`
 }
 
 type Destination struct {
@@ -33,6 +82,7 @@ type SyncPolicy struct {
 type Spec struct {
 	Project     string      `yaml:"project"`
 	Source      Source      `yaml:"source"`
+	Sources     []Source    `yaml:"sources"`
 	Destination Destination `yaml:"destination"`
 	SyncPolicy  SyncPolicy  `yaml:"syncPolicy"`
 }
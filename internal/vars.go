@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	TextOutput = "text"
+	JSONOutput = "json"
+)
+
+// VariableLister lists the placeholders of Application manifests and how
+// they resolve, without showing their values.
+type VariableLister struct {
+	Config *PluginConfig
+	// Output is text or json
+	Output string
+}
+
+// PlaceholderReport tells how a placeholder resolves.
+type PlaceholderReport struct {
+	Placeholder string `json:"placeholder"`
+	Name        string `json:"name"`
+	// Locations are the file:line the placeholder is found at
+	Locations []string `json:"locations"`
+	Resolved  bool     `json:"resolved"`
+	Provider  string   `json:"provider,omitempty"`
+	// Value is a masked preview of the value
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func NewVariableLister() *VariableLister {
+	return &VariableLister{Config: DefaultPluginConfig(), Output: TextOutput}
+}
+
+// List reports the placeholders of the manifests of a directory, or of stdin
+// when path is empty.
+func (lister *VariableLister) List(path string) {
+	if lister.Output != TextOutput && lister.Output != JSONOutput {
+		log.Fatalf("Unknown output %q, expected %s or %s", lister.Output, TextOutput, JSONOutput)
+	}
+
+	dir := path
+	if len(dir) <= 0 {
+		dir = "."
+	}
+
+	chain, err := newProviderChain(lister.Config)
+	if err != nil {
+		log.Fatalf("Error creating value providers: %v", err)
+	}
+	if err := chain.loadDotenv(dir); err != nil {
+		log.Fatalf("Error reading dotenv files: %v", err)
+	}
+	if err := chain.loadSchema(dir); err != nil {
+		log.Fatalf("Error reading variable schema: %v", err)
+	}
+
+	var reports []*PlaceholderReport
+	if len(path) <= 0 {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Error reading stdin: %v", err)
+		}
+		reports = listPlaceholders(reports, "stdin", content, chain, lister.Config)
+	} else {
+		files, err := os.ReadDir(path)
+		if err != nil {
+			log.Fatalf("Error reading directory: %v", err)
+		}
+		for _, file := range files {
+			if file.IsDir() || (!strings.HasSuffix(file.Name(), ".yaml") && !strings.HasSuffix(file.Name(), ".yml")) || file.Name() == schemaFile {
+				continue
+			}
+			content, err := os.ReadFile(filepath.Join(path, file.Name()))
+			if err != nil {
+				log.Fatalf("Error reading file: %v", err)
+			}
+			reports = listPlaceholders(reports, file.Name(), content, chain, lister.Config)
+		}
+	}
+
+	if err := writePlaceholderReports(os.Stdout, reports, lister.Output); err != nil {
+		log.Fatalf("Error writing report: %v", err)
+	}
+}
+
+// listPlaceholders adds the placeholders of a manifest stream to reports.
+// Each document is substituted with the options of its Application.
+func listPlaceholders(reports []*PlaceholderReport, file string, content []byte, chain *ProviderChain, config *PluginConfig) []*PlaceholderReport {
+	byPlaceholder := map[string]*PlaceholderReport{}
+	for _, report := range reports {
+		byPlaceholder[report.Placeholder] = report
+	}
+
+	line := 0
+	for _, document := range splitDocuments(content) {
+		application := Application{}
+		if err := yaml.Unmarshal(document, &application); err != nil {
+			application = Application{}
+		}
+
+		// The placeholders are found as generate and build resolve them, so
+		// that those of comments, or outside of the paths of the
+		// Application, are not reported
+		substituter := newChainSubstituter(chain, substitutionOptions(config, application, false))
+		substituter.observe = func(p *placeholder, r *resolved, err error) {
+			report, ok := byPlaceholder[p.raw]
+			if !ok {
+				report = &PlaceholderReport{Placeholder: p.raw, Name: p.name}
+				switch {
+				case err != nil:
+					report.Error = err.Error()
+				case r != nil:
+					report.Resolved = true
+					report.Provider = placeholderProvider(p, chain)
+					report.Value = maskValue(r.value, chain.Secret(p.name))
+				}
+				byPlaceholder[p.raw] = report
+				reports = append(reports, report)
+			}
+			report.Locations = append(report.Locations, fmt.Sprintf("%s:%d", file, line+p.line))
+		}
+		substituter.Substitute(document)
+		line += strings.Count(string(document), "\n")
+	}
+	return reports
+}
+
+// placeholderProvider names what resolved a placeholder.
+func placeholderProvider(p *placeholder, chain *ProviderChain) string {
+	if provider, ok := chain.ResolvedBy(p.name); ok {
+		return provider
+	}
+	if isReference(p.name) {
+		scheme, _, _ := strings.Cut(p.name, ":")
+		return scheme
+	}
+	// The variable is not set, the value comes from a default
+	return "default"
+}
+
+// maskValue returns a preview of a value that does not reveal it. A secret
+// is fully masked.
+func maskValue(value string, secret bool) string {
+	runes := []rune(value)
+	if len(runes) <= 0 {
+		return "(empty)"
+	}
+	if secret || len(runes) < 8 {
+		return fmt.Sprintf("*** (%d chars)", len(runes))
+	}
+	return fmt.Sprintf("%s*** (%d chars)", string(runes[:3]), len(runes))
+}
+
+func writePlaceholderReports(w io.Writer, reports []*PlaceholderReport, output string) error {
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].Name < reports[j].Name
+	})
+
+	switch output {
+	case JSONOutput:
+		if reports == nil {
+			reports = []*PlaceholderReport{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	case TextOutput:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PLACEHOLDER\tSTATUS\tPROVIDER\tVALUE\tLOCATIONS")
+		for _, report := range reports {
+			status := "unresolved"
+			switch {
+			case report.Error != "":
+				status = "error: " + report.Error
+			case report.Resolved:
+				status = "resolved"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", report.Placeholder, status, orDash(report.Provider), orDash(report.Value), strings.Join(report.Locations, ","))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output %q, expected %s or %s", output, TextOutput, JSONOutput)
+}
+
+func orDash(value string) string {
+	if len(value) <= 0 {
+		return "-"
+	}
+	return value
+}
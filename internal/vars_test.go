@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListPlaceholders(t *testing.T) {
+	t.Setenv("ARGOCD_ENV_DOMAIN", "app.example.com")
+	t.Setenv("ARGOCD_ENV_TOKEN", "s3cr3t-token")
+	dir := writeSchema(t, "variables:\n  - name: TOKEN\n    sensitive: true\n")
+
+	chain := newTestProviderChain(t, DefaultPluginConfig())
+	if err := chain.loadSchema(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	content := "domain: #DOMAIN#\ntoken: ${TOKEN}\n---\nregion: ${REGION:-eu-west-1}\nmissing: #MISSING#\nagain: #DOMAIN#\nfail: ${REQ:?not set}\n"
+	reports := listPlaceholders(nil, "app.yaml", []byte(content), chain, DefaultPluginConfig())
+
+	var out bytes.Buffer
+	if err := writePlaceholderReports(&out, reports, JSONOutput); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "s3cr3t") || strings.Contains(out.String(), "example.com") {
+		t.Errorf("values leaked in:\n%s", out.String())
+	}
+
+	var got []PlaceholderReport
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []PlaceholderReport{
+		{Placeholder: "#DOMAIN#", Name: "DOMAIN", Locations: []string{"app.yaml:1", "app.yaml:6"}, Resolved: true, Provider: argocdEnvProviderName, Value: "app*** (15 chars)"},
+		{Placeholder: "#MISSING#", Name: "MISSING", Locations: []string{"app.yaml:5"}},
+		{Placeholder: "${REGION:-eu-west-1}", Name: "REGION", Locations: []string{"app.yaml:4"}, Resolved: true, Provider: "default", Value: "eu-*** (9 chars)"},
+		{Placeholder: "${REQ:?not set}", Name: "REQ", Locations: []string{"app.yaml:7"}, Error: "REQ: not set"},
+		{Placeholder: "${TOKEN}", Name: "TOKEN", Locations: []string{"app.yaml:2"}, Resolved: true, Provider: argocdEnvProviderName, Value: "*** (12 chars)"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d placeholders, want %d:\n%s", len(got), len(want), out.String())
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func TestListPlaceholdersSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "DB_PASSWORD"), []byte("long-db-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultPluginConfig()
+	config.Providers = append(config.Providers, ProviderConfig{Type: fileProviderType, Path: dir})
+	chain := newTestProviderChain(t, config)
+
+	reports := listPlaceholders(nil, "app.yaml", []byte("password: #DB_PASSWORD#\n"), chain, config)
+	if len(reports) != 1 || reports[0].Value != "*** (16 chars)" {
+		t.Errorf("expected the value of the file provider to be masked, got %+v", reports[0])
+	}
+}
+
+func TestMaskValue(t *testing.T) {
+	tests := []struct {
+		value  string
+		secret bool
+		want   string
+	}{
+		{"", false, "(empty)"},
+		{"short", false, "*** (5 chars)"},
+		{"app.example.com", false, "app*** (15 chars)"},
+		{"app.example.com", true, "*** (15 chars)"},
+		{"éàü-unicode", false, "éàü*** (11 chars)"},
+	}
+	for _, test := range tests {
+		if got := maskValue(test.value, test.secret); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestListPlaceholdersOptions(t *testing.T) {
+	t.Setenv("ARGOCD_ENV_DOMAIN", "app.example.com")
+	chain := newTestProviderChain(t, DefaultPluginConfig())
+
+	content := `metadata:
+  annotations:
+    envsubst.plugin/mode: yaml
+    envsubst.plugin/paths: .spec.source.helm.*
+spec:
+  # TODO #COMMENTED#
+  source:
+    repoURL: https://#UNSCOPED#
+    helm:
+      values: |
+        domain: #DOMAIN#
+`
+	reports := listPlaceholders(nil, "app.yaml", []byte(content), chain, DefaultPluginConfig())
+	if len(reports) != 1 || reports[0].Name != "DOMAIN" || !reports[0].Resolved || !reflect.DeepEqual(reports[0].Locations, []string{"app.yaml:11"}) {
+		for _, report := range reports {
+			t.Errorf("unexpected placeholder %+v", report)
+		}
+	}
+}
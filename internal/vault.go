@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	vaultTokenEnv   = "VAULT_TOKEN"
+	vaultAddressEnv = "VAULT_ADDR"
+
+	vaultKubernetesAuth = "kubernetes"
+	vaultTokenAuth      = "token"
+)
+
+// vaultProvider resolves the #vault:path#key# references from a KV secrets
+// engine, version 1 or 2, and #vault:path#key#version# for a version of a
+// KV version 2 secret. Secrets are read once per run.
+type vaultProvider struct {
+	config     VaultReferencesConfig
+	httpClient *http.Client
+	// token is the Vault token, obtained on the first reference
+	token string
+	// secrets caches the data of the secrets read during this run
+	secrets map[string]map[string]interface{}
+}
+
+func newVaultProvider(config VaultReferencesConfig) (*vaultProvider, error) {
+	if len(config.Address) <= 0 {
+		config.Address = os.Getenv(vaultAddressEnv)
+	}
+	if len(config.Address) <= 0 {
+		return nil, fmt.Errorf("vault address is not set")
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(config.CACert) > 0 {
+		ca, err := os.ReadFile(config.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read vault CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", config.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &vaultProvider{
+		config:     config,
+		httpClient: &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		secrets:    map[string]map[string]interface{}{},
+	}, nil
+}
+
+func (provider *vaultProvider) Name() string {
+	return vaultReferenceScheme
+}
+
+func (provider *vaultProvider) Lookup(reference string) (string, bool, error) {
+	path, key, ok := strings.Cut(reference, "#")
+	path = strings.Trim(path, "/")
+	if !ok || path == "" || key == "" {
+		return "", false, fmt.Errorf("invalid reference %q, expected path#key", reference)
+	}
+	// A KV version 2 secret can be read at a given version with path#key#version
+	key, version, _ := strings.Cut(key, "#")
+	if len(version) > 0 {
+		if _, err := strconv.Atoi(version); err != nil {
+			return "", false, fmt.Errorf("invalid version %q in reference %q", version, reference)
+		}
+	}
+
+	cacheKey := path + "#" + version
+	data, ok := provider.secrets[cacheKey]
+	if !ok {
+		var err error
+		if data, err = provider.read(path, version); err != nil {
+			return "", false, err
+		}
+		provider.secrets[cacheKey] = data
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return "", false, fmt.Errorf("key %s not found in %s", key, path)
+	}
+	return vaultValueString(value)
+}
+
+// read returns the data of a secret, unwrapping the KV version 2 envelope.
+// An empty version reads the latest one.
+func (provider *vaultProvider) read(path string, version string) (map[string]interface{}, error) {
+	if len(provider.token) <= 0 {
+		token, err := provider.login()
+		if err != nil {
+			return nil, err
+		}
+		redactor.Add(token)
+		provider.token = token
+	}
+
+	response := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	query := ""
+	if len(version) > 0 {
+		query = "?version=" + version
+	}
+	if err := provider.do(http.MethodGet, "/v1/"+path+query, nil, &response); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	kvVersion := provider.config.KVVersion
+	if kvVersion == 0 {
+		// A KV version 2 secret wraps its data next to its metadata
+		_, hasData := response.Data["data"].(map[string]interface{})
+		_, hasMetadata := response.Data["metadata"]
+		if hasData && hasMetadata {
+			kvVersion = 2
+		}
+	}
+	if kvVersion == 2 {
+		data, ok := response.Data["data"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("read %s: not a KV version 2 secret, check that the path contains /data/", path)
+		}
+		return data, nil
+	}
+	return response.Data, nil
+}
+
+// login returns a Vault token, either the static one from the environment
+// or one obtained with the Kubernetes auth method.
+func (provider *vaultProvider) login() (string, error) {
+	method := provider.config.Auth.Method
+	if len(method) <= 0 {
+		method = vaultKubernetesAuth
+		if len(os.Getenv(vaultTokenEnv)) > 0 {
+			method = vaultTokenAuth
+		}
+	}
+
+	switch method {
+	case vaultTokenAuth:
+		token := os.Getenv(vaultTokenEnv)
+		if len(token) <= 0 {
+			return "", fmt.Errorf("%s is not set", vaultTokenEnv)
+		}
+		return token, nil
+	case vaultKubernetesAuth:
+	default:
+		return "", fmt.Errorf("unknown vault auth method %q", method)
+	}
+
+	jwtPath := provider.config.Auth.TokenPath
+	if len(jwtPath) <= 0 {
+		jwtPath = tokenPath
+	}
+	jwt, err := os.ReadFile(jwtPath)
+	if err != nil {
+		return "", fmt.Errorf("read service account token: %w", err)
+	}
+	mount := provider.config.Auth.Mount
+	if len(mount) <= 0 {
+		mount = vaultKubernetesAuth
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"role": provider.config.Auth.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return "", err
+	}
+	response := struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}{}
+	if err := provider.do(http.MethodPost, "/v1/auth/"+strings.Trim(mount, "/")+"/login", body, &response); err != nil {
+		return "", fmt.Errorf("kubernetes login with role %s: %w", provider.config.Auth.Role, err)
+	}
+	if len(response.Auth.ClientToken) <= 0 {
+		return "", fmt.Errorf("kubernetes login with role %s: no token returned", provider.config.Auth.Role)
+	}
+	return response.Auth.ClientToken, nil
+}
+
+func (provider *vaultProvider) do(method string, path string, body []byte, response interface{}) error {
+	req, err := http.NewRequest(method, provider.config.Address+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if len(provider.token) > 0 {
+		req.Header.Set("X-Vault-Token", provider.token)
+	}
+	if len(provider.config.Namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", provider.config.Namespace)
+	}
+
+	resp, err := provider.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		errResponse := struct {
+			Errors []string `json:"errors"`
+		}{}
+		_ = json.Unmarshal(bs, &errResponse)
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("not found")
+		case http.StatusForbidden:
+			return fmt.Errorf("permission denied: %s", strings.Join(errResponse.Errors, ", "))
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.Join(errResponse.Errors, ", "))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+	return decoder.Decode(response)
+}
+
+// vaultValueString returns a secret value as a string. Values that are
+// not strings are written as JSON.
+func vaultValueString(value interface{}) (string, bool, error) {
+	switch v := value.(type) {
+	case string:
+		return v, true, nil
+	case json.Number:
+		return v.String(), true, nil
+	case bool:
+		return strconv.FormatBool(v), true, nil
+	case nil:
+		return "", true, nil
+	}
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return "", false, err
+	}
+	return string(bs), true, nil
+}
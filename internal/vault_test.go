@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newFakeVault(t *testing.T) (*httptest.Server, map[string]int) {
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if r.URL.Path == "/v1/auth/kubernetes/login" {
+			login := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["jwt"] != "sa-token" || login["role"] != "argocd" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors": ["invalid role or jwt"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth": {"client_token": "k8s-token"}}`))
+			return
+		}
+
+		if token := r.Header.Get("X-Vault-Token"); token != "k8s-token" && token != "static-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/app":
+			if r.URL.Query().Get("version") == "2" {
+				w.Write([]byte(`{"data": {"data": {"password": "old-s3cr3t"}, "metadata": {"version": 2}}}`))
+				return
+			}
+			w.Write([]byte(`{"data": {"data": {"password": "s3cr3t", "port": 5432}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/app":
+			w.Write([]byte(`{"data": {"password": "v1-s3cr3t"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestVaultProviderKubernetesAuth(t *testing.T) {
+	server, requests := newFakeVault(t)
+	t.Setenv("VAULT_TOKEN", "")
+
+	jwtPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwtPath, []byte("sa-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultPluginConfig()
+	config.References.Vault = VaultReferencesConfig{
+		Enabled: true,
+		Address: server.URL,
+		Auth:    VaultAuthConfig{Role: "argocd", TokenPath: jwtPath},
+	}
+	chain := newTestProviderChain(t, config)
+
+	values := "password: #vault:secret/data/app#password#\nport: #vault:secret/data/app#port|int#\nv1: ${vault:kv/app#password}\n"
+	got, err := applyEnvOnValues([]byte(values), chain, SubstitutionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "password: s3cr3t\nport: 5432\nv1: v1-s3cr3t\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if requests["/v1/auth/kubernetes/login"] != 1 || requests["/v1/secret/data/app"] != 1 {
+		t.Errorf("expected a single login and read, got %v", requests)
+	}
+}
+
+func TestVaultProviderVersion(t *testing.T) {
+	server, _ := newFakeVault(t)
+	t.Setenv("VAULT_TOKEN", "static-token")
+
+	config := DefaultPluginConfig()
+	config.References.Vault = VaultReferencesConfig{Enabled: true, Address: server.URL}
+	chain := newTestProviderChain(t, config)
+
+	values := "current: #vault:secret/data/app#password#\nold: #vault:secret/data/app#password#2#\nshell: ${vault:secret/data/app#password#2}\nnext: #vault:secret/data/app#password# #v2#\n"
+	got, err := applyEnvOnValues([]byte(values), chain, SubstitutionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "current: s3cr3t\nold: old-s3cr3t\nshell: old-s3cr3t\nnext: s3cr3t #v2#\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestVaultProviderErrors(t *testing.T) {
+	server, _ := newFakeVault(t)
+	t.Setenv("VAULT_TOKEN", "static-token")
+
+	provider, err := newVaultProvider(VaultReferencesConfig{Enabled: true, Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		reference string
+		want      string
+	}{
+		{"secret/data/app#username", "key username not found in secret/data/app"},
+		{"secret/data/missing#password", "read secret/data/missing: not found"},
+		{"secret/data/app", "expected path#key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			_, _, err := provider.Lookup(tt.reference)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("VAULT_TOKEN", "wrong-token")
+	provider, _ = newVaultProvider(VaultReferencesConfig{Enabled: true, Address: server.URL})
+	if _, _, err := provider.Lookup("secret/data/app#password"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("got error %v, want a permission denied", err)
+	}
+}